@@ -0,0 +1,135 @@
+package gonfic
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type archiveSource struct {
+	path string
+	opts sourceOptions
+}
+
+// NewArchiveSource returns a source that loads every file with a supported
+// extension found in the zip, tar, tar.gz or tgz archive at path,
+// in sorted name order, so later files override earlier ones.
+// Other files are skipped.
+func NewArchiveSource(path string, opts ...SourceOption) Source {
+	return &archiveSource{path: path, opts: newSourceOptions(opts)}
+}
+
+type archiveEntry struct {
+	name string
+	buf  []byte
+}
+
+func (s *archiveSource) String() string {
+	return "archive:" + s.path
+}
+
+func (s *archiveSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *archiveSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	var entries []archiveEntry
+	var err error
+	lower := strings.ToLower(s.path)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		entries, err = s.readZip()
+	case strings.HasSuffix(lower, ".tar"):
+		entries, err = s.readTar(false)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		entries, err = s.readTar(true)
+	default:
+		return nil, fmt.Errorf("%s: not a zip, tar, tar.gz or tgz archive", s.path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", s.path, notFoundError(err))
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	for _, entry := range entries {
+		bufSource := &bufSource{buf: entry.buf, ext: archiveEntryExt(entry.name), opts: s.opts}
+		config, err = bufSource.OverrideContext(ctx, config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s: %w", s.path, entry.name, err)
+		}
+	}
+	return config, nil
+}
+
+func archiveEntryExt(name string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(name), "."))
+}
+
+func (s *archiveSource) readZip() ([]archiveEntry, error) {
+	r, err := zip.OpenReader(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	var entries []archiveEntry
+	for _, f := range r.File {
+		if f.FileInfo().IsDir() || !isSupportedExt(archiveEntryExt(f.Name)) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		buf, err := readAllLimited(rc, s.opts.maxBytes)
+		rc.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		entries = append(entries, archiveEntry{name: f.Name, buf: buf})
+	}
+	return entries, nil
+}
+
+func (s *archiveSource) readTar(gzipped bool) ([]archiveEntry, error) {
+	f, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if gzipped {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	}
+	tr := tar.NewReader(r)
+	var entries []archiveEntry
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.Typeflag != tar.TypeReg || !isSupportedExt(archiveEntryExt(h.Name)) {
+			continue
+		}
+		buf, err := readAllLimited(tr, s.opts.maxBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", h.Name, err)
+		}
+		entries = append(entries, archiveEntry{name: h.Name, buf: buf})
+	}
+	return entries, nil
+}
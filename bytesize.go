@@ -0,0 +1,51 @@
+package gonfic
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var byteSizeRegexp = regexp.MustCompile(`^\s*(\d+(?:\.\d+)?)\s*(?:([kmgtpe])(i?)b?|b)\s*$`)
+
+var byteSizeExponents = map[string]int{"k": 1, "m": 2, "g": 3, "t": 4, "p": 5, "e": 6}
+
+// isByteSize reports whether a value of srcType decoded unto dstType may be a byte size.
+func isByteSize(srcType reflect.Type, dstType reflect.Type) bool {
+	if srcType.Kind() != reflect.String {
+		return false
+	}
+	switch dstType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	}
+	return false
+}
+
+// parseByteSize parses a size with a unit, like 256MB (SI, so 256 * 1000^2 bytes)
+// or 4GiB (binary, so 4 * 1024^3 bytes), regardless of case and with an optional B
+// (256m is 256MB, and 512b is 512 bytes). It returns false if s has no unit,
+// leaving bare numbers to the usual decoding.
+func parseByteSize(s string) (int64, bool, error) {
+	m := byteSizeRegexp.FindStringSubmatch(strings.ToLower(s))
+	if m == nil {
+		return 0, false, nil
+	}
+	n, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return 0, true, err
+	}
+	base := 1000.0
+	if m[3] != "" {
+		base = 1024
+	}
+	size := n * math.Pow(base, float64(byteSizeExponents[m[2]]))
+	if size >= math.MaxInt64 {
+		return 0, true, fmt.Errorf("byte size %s is too large", s)
+	}
+	return int64(size), true, nil
+}
@@ -0,0 +1,88 @@
+package gonfic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+type commandSource struct {
+	name string
+	args []string
+	ext  string
+	opts sourceOptions
+}
+
+// NewCommandSource returns a source that runs the command name with args
+// and parses its standard output according to ext.
+// The command fails if it exits with a non zero status, or if it runs
+// longer than the timeout set with WithTimeout, and its error then
+// includes the command standard error.
+func NewCommandSource(name string, args []string, ext string, opts ...SourceOption) Source {
+	return &commandSource{name: name, args: args, ext: ext, opts: newSourceOptions(opts)}
+}
+
+func (s *commandSource) String() string {
+	return "command:" + s.name
+}
+
+func (s *commandSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, but the command is killed when ctx is done.
+func (s *commandSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	ctx, cancel := s.opts.context(ctx)
+	defer cancel()
+	buf, err := runCommand(ctx, exec.CommandContext(ctx, s.name, s.args...), s.opts)
+	if err != nil {
+		return nil, fmt.Errorf("cannot run %s: %w", s.name, err)
+	}
+	bufSource := &bufSource{buf: buf, ext: strings.ToLower(s.ext), opts: s.opts}
+	config, err = bufSource.OverrideContext(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.name, err)
+	}
+	return config, nil
+}
+
+// context returns a child of parent that expires after the timeout set with WithTimeout, if any.
+func (o sourceOptions) context(parent context.Context) (context.Context, context.CancelFunc) {
+	if o.timeout > 0 {
+		return context.WithTimeout(parent, o.timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+// runCommand runs cmd, created with ctx, and returns its standard output.
+// Its error includes the command standard error, if any.
+func runCommand(ctx context.Context, cmd *exec.Cmd, opts sourceOptions) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	buf, readErr := readAllLimited(stdout, opts.maxBytes)
+	if readErr != nil {
+		cmd.Process.Kill()
+	}
+	err = cmd.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", opts.timeout)
+	} else if readErr != nil {
+		err = readErr
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+	return buf, nil
+}
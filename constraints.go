@@ -0,0 +1,152 @@
+package gonfic
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// WithConstraints makes Unmarshal check the constraints declared
+// with the gonfic struct tag once the config is decoded, for example:
+//
+//	Port int    `gonfic:"min=1,max=65535"`
+//	Env  string `gonfic:"oneof=dev staging prod"`
+//
+// min and max bound numbers, or the length of strings, slices and maps.
+// oneof lists the space separated allowed values.
+// Every violation is reported, qualified by its config key.
+func WithConstraints() UnmarshalOption {
+	return func(o *unmarshalOptions) {
+		o.constraints = true
+	}
+}
+
+func checkConstraints(v interface{}) error {
+	var errs []string
+	checkConstraintsRec(reflect.ValueOf(v), "", &errs)
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func checkConstraintsRec(v reflect.Value, path string, errs *[]string) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			checkConstraintsRec(v.Elem(), path, errs)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			fpath := joinPath(path, fieldKey(f))
+			fv := v.Field(i)
+			if tag := f.Tag.Get("gonfic"); tag != "" {
+				for _, err := range checkTag(fv, tag) {
+					*errs = append(*errs, fpath+": "+err)
+				}
+			}
+			checkConstraintsRec(fv, fpath, errs)
+		}
+	case reflect.Map:
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool {
+			return fmt.Sprint(keys[i].Interface()) < fmt.Sprint(keys[j].Interface())
+		})
+		for _, key := range keys {
+			checkConstraintsRec(v.MapIndex(key), joinPath(path, fmt.Sprint(key.Interface())), errs)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			checkConstraintsRec(v.Index(i), joinPath(path, strconv.Itoa(i)), errs)
+		}
+	}
+}
+
+func checkTag(v reflect.Value, tag string) []string {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	var errs []string
+	for _, rule := range strings.Split(tag, ",") {
+		pair := strings.SplitN(strings.TrimSpace(rule), "=", 2)
+		if len(pair) != 2 {
+			errs = append(errs, fmt.Sprintf("invalid constraint %q", rule))
+			continue
+		}
+		name, arg := pair[0], pair[1]
+		switch name {
+		case "min", "max":
+			bound, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("invalid %s constraint %q", name, arg))
+				continue
+			}
+			n, ok := measure(v)
+			if !ok {
+				errs = append(errs, fmt.Sprintf("%s constraint not supported on %s", name, v.Kind()))
+				continue
+			}
+			if name == "min" && n < bound {
+				errs = append(errs, fmt.Sprintf("%v is less than min %s", v.Interface(), arg))
+			}
+			if name == "max" && n > bound {
+				errs = append(errs, fmt.Sprintf("%v is greater than max %s", v.Interface(), arg))
+			}
+		case "oneof":
+			s := fmt.Sprint(v.Interface())
+			found := false
+			for _, allowed := range strings.Fields(arg) {
+				if s == allowed {
+					found = true
+					break
+				}
+			}
+			if !found {
+				errs = append(errs, fmt.Sprintf("%q is not one of %s", s, strings.Join(strings.Fields(arg), ", ")))
+			}
+		default:
+			errs = append(errs, fmt.Sprintf("unknown constraint %q", name))
+		}
+	}
+	return errs
+}
+
+// measure returns the value of a number, or the length of a string, slice or map.
+func measure(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), true
+	}
+	return 0, false
+}
+
+// fieldKey returns the config key a struct field is decoded from.
+func fieldKey(f reflect.StructField) string {
+	if name := strings.Split(f.Tag.Get("mapstructure"), ",")[0]; name != "" {
+		return name
+	}
+	return strings.ToLower(f.Name)
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
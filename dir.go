@@ -0,0 +1,123 @@
+package gonfic
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type dirSource struct {
+	dir        string
+	precedence []string
+	recursive  bool
+	opts       []SourceOption
+}
+
+// DirOption alters the way the dir source loads the files of its directory.
+type DirOption func(*dirSource)
+
+// NewDirSource returns a source that loads every file with a supported extension
+// in dir, like a conf.d directory. By default, files are loaded in sorted name order,
+// whatever their format, so later files override earlier ones.
+// Other files and subdirectories are skipped.
+func NewDirSource(dir string, opts ...DirOption) Source {
+	s := &dirSource{dir: dir}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithFormatPrecedence loads the files by format first, then by name:
+// files with an extension not in exts come first, then the files
+// of each extension of exts in order, so with ("yaml", "env"),
+// any .env file overrides every .yaml file.
+func WithFormatPrecedence(exts ...string) DirOption {
+	return func(s *dirSource) {
+		s.precedence = nil
+		for _, ext := range exts {
+			s.precedence = append(s.precedence, strings.ToLower(strings.TrimPrefix(ext, ".")))
+		}
+	}
+}
+
+// WithRecursive also loads the files in the subdirectories of the directory,
+// each subdirectory taking the place of its name in the sorted name order
+// (conf.d/a/x.yaml comes before conf.d/b.yaml).
+func WithRecursive() DirOption {
+	return func(s *dirSource) {
+		s.recursive = true
+	}
+}
+
+// WithDirSourceOptions applies opts, like WithMaxBytes or WithIncludes, to each file of the directory.
+func WithDirSourceOptions(opts ...SourceOption) DirOption {
+	return func(s *dirSource) {
+		s.opts = append(s.opts, opts...)
+	}
+}
+
+func (s *dirSource) String() string {
+	return "dir:" + s.dir
+}
+
+func (s *dirSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *dirSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	names, err := s.list("")
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", s.dir, notFoundError(err))
+	}
+	sort.SliceStable(names, func(i, j int) bool {
+		return s.rank(names[i]) < s.rank(names[j])
+	})
+	for _, name := range names {
+		fileSource := &fileSource{path: filepath.Join(s.dir, name), opts: newSourceOptions(s.opts)}
+		config, err = fileSource.OverrideContext(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// list returns the paths, relative to the directory, of the files
+// with a supported extension in its subdirectory sub, in sorted order.
+func (s *dirSource) list(sub string) ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(s.dir, sub))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, info := range infos {
+		name := filepath.Join(sub, info.Name())
+		switch {
+		case info.IsDir() && s.recursive:
+			subnames, err := s.list(name)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, subnames...)
+		case info.Mode().IsRegular() && isSupportedExt(archiveEntryExt(name)):
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// rank returns the precedence of the format of the file name, the higher the later it is loaded.
+func (s *dirSource) rank(name string) int {
+	ext := archiveEntryExt(name)
+	for i, e := range s.precedence {
+		if e == ext {
+			return i + 1
+		}
+	}
+	return 0
+}
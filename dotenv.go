@@ -0,0 +1,69 @@
+package gonfic
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// readDotenv reads a .env file: KEY=VALUE lines, optionally prefixed by export,
+// with # comments and single or double quoted values. Variable names
+// become keys as with NewEnvSource (SERVER_PORT is server.port).
+// It returns a flat map, so a variable can be a prefix of another, like SERVER and SERVER_PORT.
+func readDotenv(buf []byte) (map[string]interface{}, error) {
+	env := &envSource{delim: "_"}
+	flat := make(map[string]interface{})
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected NAME=VALUE", n)
+		}
+		name, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		value, err := dotenvValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		flat[env.key(name, ".")] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return flat, nil
+}
+
+// dotenvValue unquotes value, or strips its trailing comment if it is not quoted.
+func dotenvValue(value string) (string, error) {
+	if value == "" {
+		return value, nil
+	}
+	switch value[0] {
+	case '\'':
+		end := strings.Index(value[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated quoted value")
+		}
+		return value[1 : end+1], nil
+	case '"':
+		for i := 1; i < len(value); i++ {
+			switch value[i] {
+			case '\\':
+				i++
+			case '"':
+				return strconv.Unquote(value[:i+1])
+			}
+		}
+		return "", fmt.Errorf("unterminated quoted value")
+	}
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = strings.TrimSpace(value[:i])
+	}
+	return value, nil
+}
@@ -0,0 +1,48 @@
+package gonfic
+
+import (
+	"errors"
+	"os"
+)
+
+// Kinds of errors returned by sources, and by AddSource and the like,
+// to be checked with errors.Is.
+var (
+	// ErrNotFound is the kind of error of a source whose file does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrParse is the kind of error of a source whose content cannot be parsed.
+	ErrParse = errors.New("parse error")
+	// ErrUnsupportedFormat is the kind of error of a source whose format
+	// (file extension) is neither built-in nor registered.
+	ErrUnsupportedFormat = errors.New("unsupported format")
+	// ErrNoMatch is the kind of error of a glob source whose pattern matches no file.
+	ErrNoMatch = errors.New("no match")
+)
+
+// Error is an error of a given Kind (ErrNotFound, ErrParse, ErrUnsupportedFormat or ErrNoMatch),
+// wrapping its cause. errors.Is reports whether an error is of a kind,
+// and errors.As retrieves the Error itself.
+type Error struct {
+	Kind error
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+// notFoundError returns err as an ErrNotFound error if it is about a file that does not exist.
+func notFoundError(err error) error {
+	if errors.Is(err, os.ErrNotExist) {
+		return &Error{Kind: ErrNotFound, Err: err}
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package gonfic
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ExpectInt declares that key, when set, must hold a value decodable unto an int.
+func (c *Config) ExpectInt(key string) {
+	c.expect(key, reflect.TypeOf(0))
+}
+
+// ExpectString declares that key, when set, must hold a value decodable unto a string.
+func (c *Config) ExpectString(key string) {
+	c.expect(key, reflect.TypeOf(""))
+}
+
+// ExpectBool declares that key, when set, must hold a value decodable unto a bool.
+func (c *Config) ExpectBool(key string) {
+	c.expect(key, reflect.TypeOf(false))
+}
+
+// ExpectFloat64 declares that key, when set, must hold a value decodable unto a float64.
+func (c *Config) ExpectFloat64(key string) {
+	c.expect(key, reflect.TypeOf(0.0))
+}
+
+// ExpectDuration declares that key, when set, must hold a value decodable unto a time.Duration.
+func (c *Config) ExpectDuration(key string) {
+	c.expect(key, reflect.TypeOf(time.Duration(0)))
+}
+
+// ExpectStringSlice declares that key, when set, must hold a value decodable unto a []string.
+func (c *Config) ExpectStringSlice(key string) {
+	c.expect(key, reflect.TypeOf([]string(nil)))
+}
+
+// expect registers the type the value of key must be weakly decodable unto.
+// AddSource and Rebuild then fail when a source sets a value that is not,
+// and ValidateTypes checks the current values.
+func (c *Config) expect(key string, t reflect.Type) {
+	c.lock()
+	defer c.unlock()
+	if c.expectations == nil {
+		c.expectations = make(map[string]reflect.Type)
+	}
+	c.expectations[strings.ToLower(key)] = t
+}
+
+// ValidateTypes checks the current values against the types declared
+// with the Expect methods, reporting every mismatch.
+func (c *Config) ValidateTypes() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.checkExpectations(c.flatMap())
+}
+
+// Require checks that each of keys is set, looked up as by Get, reporting
+// every missing key. A key ending with the separator, like "database.",
+// is a prefix, that is set if any key under it is.
+func (c *Config) Require(keys ...string) error {
+	fm := c.snapshot()
+	var missing []string
+	for _, key := range keys {
+		if !hasKey(fm, key, c.sep()) && !hasKey(fm, strings.ToLower(key), c.sep()) {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing keys: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// hasKey returns whether key, or any key under it if it ends with sep, is in fm.
+func hasKey(fm map[string]interface{}, key string, sep string) bool {
+	if !strings.HasSuffix(key, sep) {
+		_, ok := fm[key]
+		return ok
+	}
+	for k := range fm {
+		if strings.HasPrefix(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) checkExpectations(fm map[string]interface{}) error {
+	if len(c.expectations) == 0 {
+		return nil
+	}
+	var errs []string
+	for key, t := range c.expectations {
+		value, ok := fm[key]
+		if !ok || value == nil {
+			continue
+		}
+		if err := c.decode(value, reflect.New(t).Interface()); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: expected %s, got %#v", key, t, value))
+		}
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return fmt.Errorf("unexpected types: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package gonfic
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Explanation tells where the value of a key comes from.
+type Explanation struct {
+	Key string
+	// Sources are the names of the sources that set the key, in the order they were applied.
+	Sources []string
+	// Winner is the name of the source that set the current value.
+	Winner string
+}
+
+// Explain returns, for each key in sorted order, the sources that set its value
+// and the one that won. A source is only seen setting a key if it changed its value.
+// Sources are named by their String method if they have one (like "file:config.yaml"
+// or "env"), or by their type otherwise. Keys only set by SetDefault come from "default".
+func (c *Config) Explain() []Explanation {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fm := c.flatMap()
+	keys := make([]string, 0, len(fm))
+	for key := range fm {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var explanations []Explanation
+	for _, key := range keys {
+		sources := append([]string(nil), c.history[key]...)
+		if len(sources) == 0 {
+			sources = []string{"default"}
+		}
+		explanations = append(explanations, Explanation{Key: key, Sources: sources, Winner: sources[len(sources)-1]})
+	}
+	return explanations
+}
+
+// Origin returns the name of the source that set the current value of key,
+// looked up as by Get, named as by Explain, and whether key is set at all.
+func (c *Config) Origin(key string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fm := c.flatMap()
+	if _, ok := fm[key]; !ok {
+		key = strings.ToLower(key)
+	}
+	if _, ok := fm[key]; !ok {
+		return "", false
+	}
+	if _, ok := c.flat[key]; !ok {
+		return "default", true
+	}
+	sources := c.history[key]
+	if len(sources) == 0 {
+		return "default", true
+	}
+	return sources[len(sources)-1], true
+}
+
+func sourceName(s Source) string {
+	if stringer, ok := s.(fmt.Stringer); ok {
+		return stringer.String()
+	}
+	return fmt.Sprintf("%T", s)
+}
+
+type namedSourceFunc struct {
+	SourceFunc
+	name string
+}
+
+func (s *namedSourceFunc) String() string {
+	return s.name
+}
+
+// namedSource returns fn as a source named name.
+func namedSource(name string, fn SourceFunc) Source {
+	return &namedSourceFunc{SourceFunc: fn, name: name}
+}
+
+// recordHistory appends name to the history of every key whose value
+// differs from before to after, and returns the history.
+func recordHistory(history map[string][]string, before map[string]interface{}, after map[string]interface{}, name string) map[string][]string {
+	if history == nil {
+		history = make(map[string][]string)
+	}
+	for key, value := range after {
+		if old, ok := before[key]; !ok || !reflect.DeepEqual(old, value) {
+			history[key] = append(history[key], name)
+		}
+	}
+	return history
+}
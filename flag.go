@@ -0,0 +1,68 @@
+package gonfic
+
+import (
+	"flag"
+	"github.com/spf13/pflag"
+	"strings"
+)
+
+type flagSource struct {
+	fs *flag.FlagSet
+}
+
+// NewFlagSource returns a source that loads the flags of fs that were set
+// on the command line, so their defaults do not override other sources.
+// Flag names are used as keys, lowercased (-db.host is db.host).
+// fs must be parsed before the source is added.
+func NewFlagSource(fs *flag.FlagSet) Source {
+	return &flagSource{fs: fs}
+}
+
+func (s *flagSource) String() string {
+	return "flags"
+}
+
+func (s *flagSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	s.fs.Visit(func(f *flag.Flag) {
+		config[strings.ToLower(f.Name)] = f.Value.String()
+	})
+	return config, nil
+}
+
+type pflagSource struct {
+	fs *pflag.FlagSet
+}
+
+// NewPFlagSource is like NewFlagSource for a spf13/pflag (or cobra) flag set.
+// Flag names are used as normalized by the flag set, and the values
+// of slice flags (like --hosts a,b) are loaded as lists.
+func NewPFlagSource(fs *pflag.FlagSet) Source {
+	return &pflagSource{fs: fs}
+}
+
+func (s *pflagSource) String() string {
+	return "pflags"
+}
+
+func (s *pflagSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	s.fs.Visit(func(f *pflag.Flag) {
+		key := strings.ToLower(f.Name)
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			var list []interface{}
+			for _, elem := range sv.GetSlice() {
+				list = append(list, elem)
+			}
+			config[key] = list
+			return
+		}
+		config[key] = f.Value.String()
+	})
+	return config, nil
+}
+
+// BindPFlags adds a source of the flags of fs set on the command line,
+// over the sources added so far. With cobra, call it with cmd.Flags()
+// once the flags are parsed, for example in PersistentPreRunE.
+func (c *Config) BindPFlags(fs *pflag.FlagSet) error {
+	return c.AddSource(NewPFlagSource(fs))
+}
@@ -0,0 +1,275 @@
+package gonfic
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ghodss/yaml"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// formats maps each supported extension to the func reading
+// a buf of that format into an hierarchical map (or, for the flat
+// formats, into a flat map with dotted keys, so a key can be both
+// a value and the parent of other keys, like a and a.b),
+// and to the func writing an hierarchical map in that format.
+var formats = struct {
+	sync.RWMutex
+	readers map[string]func([]byte) (map[string]interface{}, error)
+	writers map[string]func(interface{}) ([]byte, error)
+	flat    map[string]bool
+}{
+	readers: map[string]func([]byte) (map[string]interface{}, error){
+		"js":         readJson,
+		"json":       readJson,
+		"yml":        readYaml,
+		"yaml":       readYaml,
+		"cbor":       readCbor,
+		"env":        readDotenv,
+		"ini":        readIni,
+		"properties": readProperties,
+		"toml":       readToml,
+		"tml":        readToml,
+	},
+	writers: map[string]func(interface{}) ([]byte, error){
+		"js":         writeJson,
+		"json":       writeJson,
+		"yml":        yaml.Marshal,
+		"yaml":       yaml.Marshal,
+		"cbor":       cbor.Marshal,
+		"hcl":        writeHcl,
+		"properties": marshalProperties,
+	},
+	flat: map[string]bool{
+		"env":        true,
+		"ini":        true,
+		"properties": true,
+	},
+}
+
+// RegisterUnmarshalFunc registers the func used to unmarshal bufs with the given extension
+// (by buf and file sources), replacing the default one if any. This allows using another
+// YAML or JSON library, or supporting a new format. unmarshal is given a pointer
+// to a map[string]interface{}; nested maps may be map[string]interface{}
+// or map[interface{}]interface{}.
+func RegisterUnmarshalFunc(ext string, unmarshal func([]byte, interface{}) error) {
+	formats.Lock()
+	defer formats.Unlock()
+	formats.readers[strings.ToLower(ext)] = func(buf []byte) (map[string]interface{}, error) {
+		return readUnmarshalableBuf(buf, unmarshal)
+	}
+	delete(formats.flat, strings.ToLower(ext))
+}
+
+// RegisterMarshalFunc registers the func used to marshal the config
+// in the format of the given extension (by Config.Bytes), replacing
+// the default one if any. marshal is given an hierarchical map[string]interface{}.
+func RegisterMarshalFunc(ext string, marshal func(interface{}) ([]byte, error)) {
+	formats.Lock()
+	defer formats.Unlock()
+	formats.writers[strings.ToLower(ext)] = marshal
+}
+
+func writeBuf(m map[string]interface{}, ext string) ([]byte, error) {
+	formats.RLock()
+	fn, ok := formats.writers[ext]
+	formats.RUnlock()
+	if !ok {
+		return nil, &Error{Kind: ErrUnsupportedFormat, Err: fmt.Errorf("%s is not a valid output format", ext)}
+	}
+	buf, err := fn(m)
+	if err != nil {
+		return nil, fmt.Errorf("cannot write %s buf: %w", ext, err)
+	}
+	return buf, nil
+}
+
+func writeJson(v interface{}) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+// isSupportedExt reports whether bufs with the given extension can be read.
+func isSupportedExt(ext string) bool {
+	formats.RLock()
+	defer formats.RUnlock()
+	_, ok := formats.readers[ext]
+	return ok
+}
+
+// readBuf reads buf according to ext into a flat map whose keys are joined by sep.
+func readBuf(buf []byte, ext string, sep string) (map[string]interface{}, error) {
+	m, flat, err := readFormat(buf, ext)
+	if err != nil {
+		return nil, err
+	}
+	if flat {
+		fm := make(map[string]interface{}, len(m))
+		for key, value := range m {
+			fm[joiner(sep)(dotSlicer(key))] = value
+		}
+		return fm, nil
+	}
+	return flatten(m, joiner(sep)), nil
+}
+
+// parseBuf parses buf according to ext into an hierarchical map.
+// A key of a flat format that is also the parent of other keys is an error.
+func parseBuf(buf []byte, ext string) (map[string]interface{}, error) {
+	m, flat, err := readFormat(buf, ext)
+	if err != nil || !flat {
+		return m, err
+	}
+	for key := range m {
+		for i := strings.LastIndex(key, "."); i > 0; i = strings.LastIndex(key[:i], ".") {
+			if _, ok := m[key[:i]]; ok {
+				return nil, &Error{Kind: ErrParse, Err: fmt.Errorf("cannot parse %s buf: %s is both a value and the parent of %s", ext, key[:i], key)}
+			}
+		}
+	}
+	return unflatten(m, dotSlicer), nil
+}
+
+// readFormat reads buf according to ext, and returns whether it is a flat format.
+func readFormat(buf []byte, ext string) (map[string]interface{}, bool, error) {
+	formats.RLock()
+	fn, ok := formats.readers[ext]
+	flat := formats.flat[ext]
+	formats.RUnlock()
+	if !ok {
+		return nil, false, &Error{Kind: ErrUnsupportedFormat, Err: unsupportedExtError(ext)}
+	}
+	m, err := fn(buf)
+	if err != nil {
+		return nil, false, &Error{Kind: ErrParse, Err: fmt.Errorf("cannot parse %s buf: %w", ext, err)}
+	}
+	return m, flat, nil
+}
+
+func unsupportedExtError(ext string) error {
+	formats.RLock()
+	exts := make([]string, 0, len(formats.readers))
+	for supported := range formats.readers {
+		exts = append(exts, supported)
+	}
+	formats.RUnlock()
+	sort.Strings(exts)
+	msg := fmt.Sprintf("%q is not a supported extension (supported: %s)", ext, strings.Join(exts, ", "))
+	best, bestDist := "", 3
+	for _, supported := range exts {
+		if d := levenshtein(ext, supported); d < bestDist {
+			best, bestDist = supported, d
+		}
+	}
+	if best != "" {
+		msg += fmt.Sprintf(", did you mean %q?", best)
+	}
+	return errors.New(msg)
+}
+
+func levenshtein(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+func readJson(buf []byte) (map[string]interface{}, error) {
+	return readUnmarshalableBuf(buf, json.Unmarshal)
+}
+
+// readYaml reads YAML through its JSON conversion; anchors, aliases
+// and merge keys are resolved by the YAML parser before that conversion.
+func readYaml(buf []byte) (map[string]interface{}, error) {
+	return readUnmarshalableBuf(buf, yaml.Unmarshal)
+}
+
+// readToml reads TOML; tables are maps, and arrays of tables
+// are lists of maps, as in YAML.
+func readToml(buf []byte) (map[string]interface{}, error) {
+	return readUnmarshalableBuf(buf, toml.Unmarshal)
+}
+
+func readCbor(buf []byte) (map[string]interface{}, error) {
+	// decode nested maps as map[string]interface{} so they can be flattened,
+	// and integers as int64 so they are weakly decodable unto any number;
+	// byte strings are kept as []byte, which weakly decode unto strings
+	dm, err := cbor.DecOptions{
+		DefaultMapType: reflect.TypeOf(map[string]interface{}(nil)),
+		IntDec:         cbor.IntDecConvertSigned,
+	}.DecMode()
+	if err != nil {
+		return nil, err
+	}
+	return readUnmarshalableBuf(buf, dm.Unmarshal)
+}
+
+func readUnmarshalableBuf(buf []byte, unmarshal func([]byte, interface{}) error) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	err := unmarshal(buf, &m)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshall: %w", err)
+	}
+	return normalizeMap(m), nil
+}
+
+// normalizeMap converts, recursively, the map[interface{}]interface{}
+// some libraries produce to map[string]interface{}, so they can be flattened.
+func normalizeMap(m map[string]interface{}) map[string]interface{} {
+	for key, value := range m {
+		m[key] = normalizeValue(value)
+	}
+	return m
+}
+
+func normalizeValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return normalizeMap(value)
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for key, subvalue := range value {
+			m[fmt.Sprint(key)] = normalizeValue(subvalue)
+		}
+		return m
+	case []interface{}:
+		for i, elem := range value {
+			value[i] = normalizeValue(elem)
+		}
+		return value
+	case []map[string]interface{}:
+		list := make([]interface{}, len(value))
+		for i, elem := range value {
+			list[i] = normalizeMap(elem)
+		}
+		return list
+	}
+	return value
+}
@@ -0,0 +1,49 @@
+package gonfic
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+type fsSource struct {
+	fsys fs.FS
+	path string
+	opts sourceOptions
+}
+
+// NewFSSource returns a source like NewFileSource, but reading the file at path
+// in fsys, for example a config file bundled in the binary with an embed.FS.
+func NewFSSource(fsys fs.FS, path string, opts ...SourceOption) Source {
+	return &fsSource{fsys: fsys, path: path, opts: newSourceOptions(opts)}
+}
+
+func (s *fsSource) String() string {
+	return "fs:" + s.path
+}
+
+func (s *fsSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *fsSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	f, err := s.fsys.Open(s.path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read: %w", notFoundError(err))
+	}
+	defer f.Close()
+	buf, err := readAllLimited(f, s.opts.maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read: %w", err)
+	}
+	ext := strings.TrimPrefix(filepath.Ext(s.path), ".")
+	bufSource := &bufSource{buf: buf, ext: strings.ToLower(ext), opts: s.opts}
+	config, err = bufSource.OverrideContext(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	return config, nil
+}
@@ -0,0 +1,262 @@
+package gonfic
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Get returns the raw value of key, and whether the key is set.
+// As sources lowercase their keys, key is also looked up lowercased.
+// A key explicitly set to null (key: null in YAML) is set, with a nil value.
+// A separator in a key component is escaped by a backslash,
+// like in hosts.example\.com.port.
+// An element of a list, or a key under it, is got by its index, like servers.1.host.
+func (c *Config) Get(key string) (interface{}, bool) {
+	fm := c.snapshot()
+	if value, ok := fm[key]; ok {
+		return value, true
+	}
+	if value, ok := fm[strings.ToLower(key)]; ok {
+		return value, true
+	}
+	return c.element(strings.ToLower(key))
+}
+
+// element returns the value of the indexed key, like servers.1.host,
+// and whether it is in a list of the config.
+func (c *Config) element(key string) (interface{}, bool) {
+	keys := slicer(c.sep())(key)
+	indexed := false
+	for _, k := range keys {
+		indexed = indexed || isIndex(k)
+	}
+	if !indexed {
+		return nil, false
+	}
+	var node interface{} = c.hierarchical()
+	inList := false
+	for _, k := range keys {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			value, ok := n[k]
+			if !ok {
+				return nil, false
+			}
+			node = value
+		case []interface{}:
+			i, err := strconv.Atoi(k)
+			if err != nil || !isIndex(k) || i >= len(n) {
+				return nil, false
+			}
+			node = n[i]
+			inList = true
+		default:
+			return nil, false
+		}
+	}
+	if !inList {
+		return nil, false
+	}
+	if sub, ok := node.(map[string]interface{}); ok {
+		node = copyTree(sub)
+	}
+	return node, true
+}
+
+// GetString returns the value of key as a string, weakly converted
+// as by Unmarshal, and whether key is set with a convertible value.
+func (c *Config) GetString(key string) (string, bool) {
+	var s string
+	ok := c.getAs(key, &s)
+	return s, ok
+}
+
+// GetInt returns the value of key as an int, weakly converted
+// as by Unmarshal (so "42" is 42), and whether key is set with a convertible value.
+func (c *Config) GetInt(key string) (int, bool) {
+	var i int
+	ok := c.getAs(key, &i)
+	return i, ok
+}
+
+// GetBool returns the value of key as a bool, weakly converted
+// as by Unmarshal (so "true" or 1 are true), and whether key is set with a convertible value.
+func (c *Config) GetBool(key string) (bool, bool) {
+	var b bool
+	ok := c.getAs(key, &b)
+	return b, ok
+}
+
+// GetFloat64 returns the value of key as a float64, weakly converted
+// as by Unmarshal, and whether key is set with a convertible value.
+func (c *Config) GetFloat64(key string) (float64, bool) {
+	var f float64
+	ok := c.getAs(key, &f)
+	return f, ok
+}
+
+// getAs decodes the value of key unto out, and reports whether it could.
+// A key set to null leaves out untouched.
+func (c *Config) getAs(key string, out interface{}) bool {
+	value, ok := c.Get(key)
+	if !ok {
+		return false
+	}
+	return c.decode(value, out) == nil
+}
+
+// GetStringMap returns the keys and values under prefix as an hierarchical map,
+// relative to prefix.
+func (c *Config) GetStringMap(prefix string) map[string]interface{} {
+	return unflatten(subFlatMap(c.snapshot(), c.keyPrefix(prefix), c.sep()), slicer(c.sep()))
+}
+
+// GetStringMapString returns the values under prefix as strings,
+// keyed by the rest of their key after prefix.
+func (c *Config) GetStringMapString(prefix string) map[string]string {
+	prefix = c.keyPrefix(prefix)
+	sfm := subFlatMap(c.snapshot(), prefix, c.sep())
+	m := make(map[string]string, len(sfm))
+	for key, value := range sfm {
+		var s string
+		if err := c.decode(value, &s); err != nil {
+			s = fmt.Sprint(value)
+		}
+		m[key] = s
+	}
+	return m
+}
+
+// GetStringMapStringSlice returns the values under prefix as string slices,
+// keyed by the rest of their key after prefix, like a routing table
+// {"/api": ["GET", "POST"]}. A scalar value gives a single element slice.
+func (c *Config) GetStringMapStringSlice(prefix string) map[string][]string {
+	prefix = c.keyPrefix(prefix)
+	sfm := subFlatMap(c.snapshot(), prefix, c.sep())
+	m := make(map[string][]string, len(sfm))
+	for key, value := range sfm {
+		var a []string
+		if err := c.decode(value, &a); err != nil {
+			elems, ok := value.([]interface{})
+			if !ok {
+				elems = []interface{}{value}
+			}
+			a = make([]string, len(elems))
+			for i, elem := range elems {
+				if err := c.decode(elem, &a[i]); err != nil {
+					a[i] = fmt.Sprint(elem)
+				}
+			}
+		}
+		m[key] = a
+	}
+	return m
+}
+
+// GetStringSliceOr returns the value of key as a slice of strings,
+// or def if key is not set or its value cannot be converted.
+// A key explicitly set to null gives an empty slice rather than def.
+func (c *Config) GetStringSliceOr(key string, def []string) []string {
+	value, ok := c.Get(key)
+	if !ok {
+		return def
+	}
+	a := []string{}
+	if value == nil {
+		return a
+	}
+	if err := c.decode(value, &a); err != nil {
+		return def
+	}
+	return a
+}
+
+// GetStringMapOr is like GetStringMap, but returns def if there is no key under prefix.
+func (c *Config) GetStringMapOr(prefix string, def map[string]interface{}) map[string]interface{} {
+	if m := c.GetStringMap(prefix); len(m) > 0 {
+		return m
+	}
+	return def
+}
+
+// GetStringMapStringOr is like GetStringMapString, but returns def if there is no key under prefix.
+func (c *Config) GetStringMapStringOr(prefix string, def map[string]string) map[string]string {
+	if m := c.GetStringMapString(prefix); len(m) > 0 {
+		return m
+	}
+	return def
+}
+
+// GetStringMapStringSliceOr is like GetStringMapStringSlice, but returns def if there is no key under prefix.
+func (c *Config) GetStringMapStringSliceOr(prefix string, def map[string][]string) map[string][]string {
+	if m := c.GetStringMapStringSlice(prefix); len(m) > 0 {
+		return m
+	}
+	return def
+}
+
+// GetDuration returns the value of key as a duration, from a string
+// parsed by time.ParseDuration (like "30s"), or from a number of nanoseconds.
+// It returns 0 if key is not set.
+func (c *Config) GetDuration(key string) (time.Duration, error) {
+	value, ok := c.Get(key)
+	if !ok || value == nil {
+		return 0, nil
+	}
+	d, err := toDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", key, err)
+	}
+	return d, nil
+}
+
+// GetDurationSlice returns the value of key as a slice of durations,
+// from a list of values, or from a comma separated string ("1s, 2s, 4s").
+// Strings are parsed by time.ParseDuration, and numbers are nanoseconds.
+// It returns nil if key is not set.
+func (c *Config) GetDurationSlice(key string) ([]time.Duration, error) {
+	value, ok := c.Get(key)
+	if !ok || value == nil {
+		return nil, nil
+	}
+	var elems []interface{}
+	switch value := value.(type) {
+	case string:
+		for _, elem := range strings.Split(value, ",") {
+			elems = append(elems, strings.TrimSpace(elem))
+		}
+	case []interface{}:
+		elems = value
+	default:
+		elems = []interface{}{value}
+	}
+	ds := make([]time.Duration, len(elems))
+	for i, elem := range elems {
+		d, err := toDuration(elem)
+		if err != nil {
+			return nil, fmt.Errorf("%s[%d]: %w", key, i, err)
+		}
+		ds[i] = d
+	}
+	return ds, nil
+}
+
+func toDuration(value interface{}) (time.Duration, error) {
+	switch value := value.(type) {
+	case time.Duration:
+		return value, nil
+	case string:
+		return time.ParseDuration(value)
+	case int:
+		return time.Duration(value), nil
+	case int64:
+		return time.Duration(value), nil
+	case uint64:
+		return time.Duration(value), nil
+	case float64:
+		return time.Duration(value), nil
+	}
+	return 0, fmt.Errorf("cannot convert %#v to a duration", value)
+}
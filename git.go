@@ -0,0 +1,119 @@
+package gonfic
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+)
+
+type gitSource struct {
+	url  string
+	ref  string
+	path string
+	env  []string
+	opts sourceOptions
+}
+
+// GitOption alters the way the git source fetches the repository.
+type GitOption func(*gitSource)
+
+// NewGitSource returns a source that loads the file at path, parsed
+// according to its extension, in the git repository at url, as of ref
+// (a branch or a tag). Only the commit of ref is fetched, with no history,
+// using the git command, which must be installed. A url or ref starting
+// with a - is rejected, so it cannot be taken by git as an option.
+func NewGitSource(url string, ref string, path string, opts ...GitOption) Source {
+	s := &gitSource{url: url, ref: ref, path: path, opts: newSourceOptions(nil)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithGitBasicAuth authenticates to an http(s) repository with username and password
+// (or a token). They are given to git in its environment, not on its command line.
+func WithGitBasicAuth(username string, password string) GitOption {
+	return func(s *gitSource) {
+		auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		s.env = append(s.env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader", "GIT_CONFIG_VALUE_0=Authorization: Basic "+auth)
+	}
+}
+
+// WithGitSSHKey authenticates to an ssh repository with the private key file at keyPath.
+func WithGitSSHKey(keyPath string) GitOption {
+	return func(s *gitSource) {
+		s.env = append(s.env, "GIT_SSH_COMMAND=ssh -i "+shellQuote(keyPath)+" -o IdentitiesOnly=yes")
+	}
+}
+
+// shellQuote returns s quoted for a POSIX shell, which reads it as is.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// WithGitSourceOptions applies opts, like WithMaxBytes or WithTimeout, to the git source.
+func WithGitSourceOptions(opts ...SourceOption) GitOption {
+	return func(s *gitSource) {
+		for _, opt := range opts {
+			opt(&s.opts)
+		}
+	}
+}
+
+func (s *gitSource) String() string {
+	return "git:" + s.url + "@" + s.ref + ":" + s.path
+}
+
+func (s *gitSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, but git is killed when ctx is done.
+func (s *gitSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	buf, err := s.fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s from %s at %s: %w", s.path, s.url, s.ref, err)
+	}
+	ext := strings.ToLower(strings.TrimPrefix(path.Ext(s.path), "."))
+	bufSource := &bufSource{buf: buf, ext: ext, opts: s.opts}
+	config, err = bufSource.OverrideContext(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	return config, nil
+}
+
+func (s *gitSource) fetch(ctx context.Context) ([]byte, error) {
+	if strings.HasPrefix(s.url, "-") || strings.HasPrefix(s.ref, "-") {
+		return nil, fmt.Errorf("invalid url or ref: cannot start with -")
+	}
+	dir, err := ioutil.TempDir("", "gonfic-git")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	ctx, cancel := s.opts.context(ctx)
+	defer cancel()
+	git := func(args ...string) ([]byte, error) {
+		cmd := exec.CommandContext(ctx, "git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(append(os.Environ(), "GIT_TERMINAL_PROMPT=0"), s.env...)
+		return runCommand(ctx, cmd, s.opts)
+	}
+	if _, err := git("init", "--quiet", "--bare"); err != nil {
+		return nil, err
+	}
+	if _, err := git("fetch", "--quiet", "--depth", "1", s.url, s.ref); err != nil {
+		return nil, err
+	}
+	buf, err := git("show", "FETCH_HEAD:"+strings.TrimPrefix(s.path, "/"))
+	if err != nil && strings.Contains(err.Error(), "does not exist") {
+		return nil, &Error{Kind: ErrNotFound, Err: err}
+	}
+	return buf, err
+}
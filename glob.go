@@ -0,0 +1,48 @@
+package gonfic
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sort"
+)
+
+type globSource struct {
+	pattern string
+	opts    []SourceOption
+}
+
+// NewGlobSource returns a source that loads, in sorted order, every file
+// matching the shell pattern (see filepath.Match), like configs/*.yaml.
+// It fails with an ErrNoMatch error if no file matches.
+func NewGlobSource(pattern string, opts ...SourceOption) Source {
+	return &globSource{pattern: pattern, opts: opts}
+}
+
+func (s *globSource) String() string {
+	return "glob:" + s.pattern
+}
+
+func (s *globSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *globSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	paths, err := filepath.Glob(s.pattern)
+	if err != nil {
+		return nil, fmt.Errorf("cannot expand %s: %w", s.pattern, err)
+	}
+	if len(paths) == 0 {
+		return nil, &Error{Kind: ErrNoMatch, Err: fmt.Errorf("%s: no matching file", s.pattern)}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		fileSource := &fileSource{path: path, opts: newSourceOptions(s.opts)}
+		config, err = fileSource.OverrideContext(ctx, config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
@@ -1,15 +1,20 @@
 package gonfic
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/ghodss/yaml"
 	"github.com/mitchellh/mapstructure"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,77 +25,1239 @@ type Source interface {
 	Override(map[string]interface{}) (map[string]interface{}, error)
 }
 
+// SourceFunc is an adapter to allow the use of an ordinary function as a Source.
+type SourceFunc func(map[string]interface{}) (map[string]interface{}, error)
+
+// Override calls f(config).
+func (f SourceFunc) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return f(config)
+}
+
+// SourceOption alters the way a source reads its content.
+type SourceOption func(*sourceOptions)
+
+type sourceOptions struct {
+	includes bool
+	maxBytes int64
+	timeout  time.Duration
+}
+
+// DefaultMaxBytes is the size over which a source refuses to read its content,
+// unless changed with WithMaxBytes.
+const DefaultMaxBytes = 10 << 20
+
+// WithMaxBytes sets the size over which a source refuses to read its content,
+// guarding against huge or malicious inputs (no limit if n <= 0).
+func WithMaxBytes(n int64) SourceOption {
+	return func(o *sourceOptions) {
+		o.maxBytes = n
+	}
+}
+
+// WithTimeout sets how long a source may take to fetch its content
+// (no limit if d <= 0, the default).
+func WithTimeout(d time.Duration) SourceOption {
+	return func(o *sourceOptions) {
+		o.timeout = d
+	}
+}
+
+func newSourceOptions(opts []SourceOption) sourceOptions {
+	o := sourceOptions{maxBytes: DefaultMaxBytes}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 // Config holds keys and values from different sources and
 // can transform them into hierarchical map, flat map or
 // unmarshal them unto a struct.
+// It is safe for concurrent use: a modification, like AddSource or Set,
+// waits for the reads in progress and blocks the others until it is done.
+// Sources, observers and tracers run while the config is locked, so they must not use it.
 type Config struct {
-	flat map[string]interface{}
+	flat          map[string]interface{}
+	defaults      map[string]interface{}
+	sources       []sourceEntry
+	location      *time.Location
+	subscriptions map[int]*subscription
+	subscribed    int
+	conflictError bool
+	expectations  map[string]reflect.Type
+	history       map[string][]string
+	observer      func(SourceEvent)
+	metrics       Metrics
+	tracer        Tracer
+	mergeStrategy MergeStrategy
+	keyStrategies map[string]MergeStrategy
+	separator     string
+	decodeHooks   []mapstructure.DecodeHookFunc
+	timeLayouts   []string
+	listDelimiter *string
+	redactedKeys  []string
+	changes       []change
+	mu            sync.RWMutex
+	tree          map[string]interface{}
+	treeMu        sync.Mutex
 }
 
-func NewConfig() *Config {
+// Option alters the way a config behaves.
+type Option func(*Config)
+
+func NewConfig(opts ...Option) *Config {
 	c := &Config{}
 	c.flat = make(map[string]interface{})
+	c.defaults = make(map[string]interface{})
+	c.location = time.UTC
+	for _, opt := range opts {
+		opt(c)
+	}
 	return c
 }
 
+// WithTimeLayouts adds layouts, as for time.Parse, to the ones tried when decoding
+// unto a time.Time a value that is not in RFC 3339 format, before the built-in
+// ones ("2006-01-02 15:04:05", "2006-01-02", "15:04" and the like).
+// A value without a time zone is in the location set with WithLocation.
+func WithTimeLayouts(layouts ...string) Option {
+	return func(c *Config) {
+		c.timeLayouts = append(c.timeLayouts, layouts...)
+	}
+}
+
+// WithListDelimiter sets the delimiter a string is split on when decoded unto
+// a slice, like TAGS=a,b,c from the env for a []string (defaults to a comma).
+// Each element is trimmed of its spaces. With an empty delimiter, a string
+// is not split, but still decoded as a slice of one element.
+func WithListDelimiter(delim string) Option {
+	return func(c *Config) {
+		c.listDelimiter = &delim
+	}
+}
+
+// WithLocation sets the location used when decoding unto a time.Time
+// a value that does not specify a time zone, like "2006-01-02 15:04" or "09:00"
+// (defaults to UTC). A value with an explicit offset, like an RFC 3339
+// "2006-01-02T15:04:05+02:00", keeps its own offset.
+func WithLocation(loc *time.Location) Option {
+	return func(c *Config) {
+		c.location = loc
+	}
+}
+
+// WithConflictError makes AddSource (and Rebuild) fail when a source
+// changes the value of a key that a previous source already set,
+// enforcing a single authoritative source for each key.
+func WithConflictError() Option {
+	return func(c *Config) {
+		c.conflictError = true
+	}
+}
+
+// SetDefault registers a default value for key, used only
+// when no source sets that key. If value is a map, it is flattened
+// so each of its leaves becomes a default under key.
+func (c *Config) SetDefault(key string, value interface{}) {
+	key = strings.ToLower(key)
+	c.lock()
+	defer c.unlock()
+	c.update(func() {
+		defaults := copyFlatMap(c.defaults)
+		if m, ok := value.(map[string]interface{}); ok {
+			for subkey, subvalue := range flatten(m, joiner(c.sep())) {
+				defaults[key+c.sep()+strings.ToLower(subkey)] = subvalue
+			}
+		} else {
+			defaults[key] = value
+		}
+		c.defaults = defaults
+	})
+}
+
+// Set overrides the value of key, over every source added so far.
+// If value is a map, it is flattened so each of its leaves is set under key.
+// Unlike a source, it cannot fail: it is not checked for conflicts or
+// against expectations, and it replaces lists whatever the merge strategy.
+// It is recorded as a step that sets the value again when the sources are
+// loaded again, in its place by ReplaceSource or a Watch reload, and after
+// the new sources by Rebuild.
+func (c *Config) Set(key string, value interface{}) {
+	key = strings.ToLower(key)
+	fm := map[string]interface{}{key: value}
+	if m, ok := value.(map[string]interface{}); ok {
+		fm = make(map[string]interface{})
+		for subkey, subvalue := range flatten(m, joiner(c.sep())) {
+			fm[key+c.sep()+strings.ToLower(subkey)] = subvalue
+		}
+	}
+	c.set("set", fm)
+}
+
+// Unset removes key, and the keys under it, over every source added so far,
+// so the defaults registered for them, if any, apply again. Like Set,
+// it is recorded as a step that removes them again when the sources are loaded again.
+func (c *Config) Unset(key string) {
+	key = strings.ToLower(key)
+	c.step(&stepSource{name: "unset", fn: func(c *Config, config map[string]interface{}) (map[string]interface{}, error) {
+		for k := range config {
+			if k == key || strings.HasPrefix(k, key+c.sep()) {
+				delete(config, k)
+			}
+		}
+		return config, nil
+	}})
+}
+
+// Merge overrides the config with every key and value of other (including
+// its defaults), so other wins on conflicts, as a source added last would.
+// Like Set, it cannot fail. other is left untouched.
+func (c *Config) Merge(other *Config) {
+	c.set("merge", copyFlatMap(other.ToFlatMap()))
+}
+
+// Diff compares the flat maps of the config and other (defaults included):
+// added holds the keys and values only in other, removed the keys and values
+// only in the config, and changed the keys in both, with the value of other,
+// whose values differ, lists and maps being compared by their content.
+func (c *Config) Diff(other *Config) (added, removed, changed map[string]interface{}) {
+	before, after := c.snapshot(), other.snapshot()
+	added = make(map[string]interface{})
+	removed = make(map[string]interface{})
+	changed = make(map[string]interface{})
+	for key, value := range after {
+		if old, ok := before[key]; !ok {
+			added[key] = value
+		} else if !reflect.DeepEqual(old, value) {
+			changed[key] = value
+		}
+	}
+	for key, value := range before {
+		if _, ok := after[key]; !ok {
+			removed[key] = value
+		}
+	}
+	return added, removed, changed
+}
+
+// set overrides the config with the keys and values of the flat map fm,
+// as a step named name that is recorded, but not checked.
+func (c *Config) set(name string, fm map[string]interface{}) {
+	c.step(setStep(name, fm))
+}
+
+func setStep(name string, fm map[string]interface{}) *stepSource {
+	return &stepSource{name: name, values: fm, fn: func(_ *Config, config map[string]interface{}) (map[string]interface{}, error) {
+		for key, value := range fm {
+			config[key] = value
+		}
+		return config, nil
+	}}
+}
+
+// stepSource is a modification of the config, like Set or Resolve, recorded
+// as a source so that it is applied again when the sources are. It is not
+// checked like the sources are, and fn gets the config to read its defaults.
+// values are the keys and values set by a step of set, if it is one.
+type stepSource struct {
+	name   string
+	values map[string]interface{}
+	fn     func(c *Config, config map[string]interface{}) (map[string]interface{}, error)
+}
+
+func (s *stepSource) String() string {
+	return s.name
+}
+
+// Override fails, since a step needs a config, see Config.override.
+func (s *stepSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return nil, fmt.Errorf("cannot apply %s out of a config", s.name)
+}
+
+// step applies s to the config and records it. If s fails, the config is left untouched.
+// A step of set following another one of the same name is merged with it,
+// so that many calls to Set do not keep as many flat maps.
+func (c *Config) step(s *stepSource) error {
+	c.lock()
+	defer c.unlock()
+	sources := c.sources
+	if n := len(sources); n > 0 && s.values != nil {
+		if last, ok := sources[n-1].source.(*stepSource); ok && last.name == s.name && last.values != nil {
+			values := copyFlatMap(last.values)
+			for key, value := range s.values {
+				values[key] = value
+			}
+			s = setStep(s.name, values)
+			sources = sources[: n-1 : n-1]
+		}
+	}
+	flat, err := s.fn(c, copyFlatMap(c.flat))
+	if err != nil {
+		return err
+	}
+	c.update(func() {
+		c.history = recordHistory(c.history, c.flat, flat, sourceName(s))
+		c.flat = flat
+		c.sources = append(sources, sourceEntry{source: s, flat: flat})
+	})
+	return nil
+}
+
 // AddSource is used to load keys and values into the config.
+// If the source fails, the config is left untouched.
 func (c *Config) AddSource(s Source) error {
-	flat, err := s.Override(c.flat)
+	return c.measure(c.addSource(context.Background(), "", s))
+}
+
+// AddNamedSource is like AddSource, but names the source
+// so it can later be swapped with ReplaceSource.
+// It fails if a source with the same name was already added.
+func (c *Config) AddNamedSource(name string, s Source) error {
+	return c.measure(c.addSource(context.Background(), name, s))
+}
+
+// sourceEntry is a source added to the config, with
+// the flat map as it was once the source was applied.
+type sourceEntry struct {
+	name   string
+	source Source
+	flat   map[string]interface{}
+}
+
+func (c *Config) addSource(ctx context.Context, name string, s Source) error {
+	c.lock()
+	defer c.unlock()
+	if name != "" && c.sourceIndex(name) >= 0 {
+		return fmt.Errorf("source %q already added", name)
+	}
+	flat, err := c.apply(ctx, c.flat, s)
+	if err != nil {
+		return err
+	}
+	c.update(func() {
+		c.history = recordHistory(c.history, c.flat, flat, sourceName(s))
+		c.flat = flat
+		c.sources = append(c.sources, sourceEntry{name: name, source: s, flat: flat})
+	})
+	return nil
+}
+
+// ReplaceSource swaps the source added with AddNamedSource under name by s,
+// keeping its place in the order of the sources. The sources added before it
+// are not loaded again, but s and every source added after it are.
+// If any source fails, the config is left untouched.
+func (c *Config) ReplaceSource(name string, s Source) error {
+	return c.measure(c.replaceSource(name, s))
+}
+
+func (c *Config) replaceSource(name string, s Source) error {
+	c.lock()
+	defer c.unlock()
+	i := c.sourceIndex(name)
+	if i < 0 {
+		return fmt.Errorf("no source named %q", name)
+	}
+	flat := make(map[string]interface{})
+	if i > 0 {
+		flat = c.sources[i-1].flat
+	}
+	replaced := append([]sourceEntry{{name: name, source: s}}, c.sources[i+1:]...)
+	replayed, err := c.replay(flat, replaced)
+	if err != nil {
+		return err
+	}
+	entries := append(append([]sourceEntry(nil), c.sources[:i]...), replayed...)
+	c.commit(entries)
+	return nil
+}
+
+func (c *Config) sourceIndex(name string) int {
+	for i, e := range c.sources {
+		if e.name != "" && e.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// replay applies, in order, the sources of entries on flat,
+// and returns the entries with the resulting flat maps.
+func (c *Config) replay(flat map[string]interface{}, entries []sourceEntry) ([]sourceEntry, error) {
+	replayed := make([]sourceEntry, len(entries))
+	for i, e := range entries {
+		applied, err := c.apply(context.Background(), flat, e.source)
+		if err != nil {
+			return nil, err
+		}
+		replayed[i] = sourceEntry{name: e.name, source: e.source, flat: applied}
+		flat = applied
+	}
+	return replayed, nil
+}
+
+// commit replaces the config content with the result of entries.
+func (c *Config) commit(entries []sourceEntry) {
+	flat := make(map[string]interface{})
+	var history map[string][]string
+	for _, e := range entries {
+		history = recordHistory(history, flat, e.flat, sourceName(e.source))
+		flat = e.flat
+	}
+	c.update(func() {
+		c.flat = flat
+		c.sources = entries
+		c.history = history
+	})
+}
+
+// MergeFlatMap overrides the config with the keys and values of fm,
+// which must already be flat: keys are used as is, and values must not be maps.
+// It fails, leaving the config untouched, if a key is empty or has an empty component.
+func (c *Config) MergeFlatMap(fm map[string]interface{}) error {
+	return c.AddSource(namedSource("flat map", func(config map[string]interface{}) (map[string]interface{}, error) {
+		for key, value := range fm {
+			for _, k := range slicer(c.sep())(key) {
+				if k == "" {
+					return nil, fmt.Errorf("invalid flat key %q", key)
+				}
+			}
+			if _, ok := value.(map[string]interface{}); ok {
+				return nil, fmt.Errorf("value of flat key %q is a map", key)
+			}
+			config[key] = value
+		}
+		return config, nil
+	}))
+}
+
+// Reset clears every key and value loaded into the config,
+// as well as the sources that were added so far.
+func (c *Config) Reset() {
+	c.lock()
+	defer c.unlock()
+	c.update(func() {
+		c.flat = make(map[string]interface{})
+		c.sources = nil
+		c.history = nil
+	})
+}
+
+// Rebuild replaces the config content with the keys and values
+// loaded from sources, applied in order on an empty flat map.
+// Since Override only adds or overwrites keys, reloading by calling
+// AddSource again would keep keys removed from a source since the
+// last load, so to reload, call Rebuild with the full list of sources.
+// Names given with AddNamedSource are forgotten, but the steps, made by
+// Set, Unset, Merge, Resolve or ExpandTemplate, are applied again, in order, after the sources.
+// If any source fails, the config is left untouched.
+func (c *Config) Rebuild(sources ...Source) error {
+	return c.measure(c.rebuild(sources))
+}
+
+func (c *Config) rebuild(sources []Source) error {
+	c.lock()
+	defer c.unlock()
+	entries := make([]sourceEntry, 0, len(sources))
+	for _, s := range sources {
+		entries = append(entries, sourceEntry{source: s})
+	}
+	for _, e := range c.sources {
+		if s, ok := e.source.(*stepSource); ok {
+			entries = append(entries, sourceEntry{source: s})
+		}
+	}
+	entries, err := c.replay(make(map[string]interface{}), entries)
 	if err != nil {
 		return err
 	}
-	c.flat = flat
+	c.commit(entries)
+	return nil
+}
+
+// LoadAtomic loads sources into the config, in order, like as many
+// calls to AddSource, except that if any source fails, the config is
+// left untouched instead of keeping the sources loaded before the failing one.
+func (c *Config) LoadAtomic(sources ...Source) error {
+	return c.measure(c.loadAtomic(sources))
+}
+
+func (c *Config) loadAtomic(sources []Source) error {
+	c.lock()
+	defer c.unlock()
+	scratch := c.clone()
+	for _, s := range sources {
+		if err := scratch.addSource(context.Background(), "", s); err != nil {
+			return err
+		}
+	}
+	c.update(func() {
+		c.flat = scratch.flat
+		c.sources = scratch.sources
+		c.history = scratch.history
+	})
 	return nil
 }
 
+// Overlay returns a new config made of the config with s added,
+// leaving the config itself unchanged, for example to derive
+// a request scoped config from a base one.
+// The new config has none of the config subscriptions.
+func (c *Config) Overlay(s Source) (*Config, error) {
+	c.mu.RLock()
+	overlay := c.clone()
+	c.mu.RUnlock()
+	if err := overlay.AddSource(s); err != nil {
+		return nil, err
+	}
+	return overlay, nil
+}
+
+// Clone returns a copy of the config, with its sources, defaults and options,
+// that can be changed, by AddSource or Set for example, without changing the config.
+// Values are deep copied, so modifying a list or a map got from the copy
+// does not modify the config either. The copy has none of the config subscriptions.
+func (c *Config) Clone() *Config {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	clone := c.clone()
+	clone.flat = deepCopyFlatMap(clone.flat)
+	clone.defaults = deepCopyFlatMap(clone.defaults)
+	for i, e := range clone.sources {
+		clone.sources[i].flat = deepCopyFlatMap(e.flat)
+	}
+	return clone
+}
+
+func deepCopyFlatMap(fm map[string]interface{}) map[string]interface{} {
+	return deepCopyValue(reflect.ValueOf(fm)).Interface().(map[string]interface{})
+}
+
+// clone returns a copy of the config that can be changed without
+// changing the config, and that has none of its subscriptions.
+// The config must be locked.
+func (c *Config) clone() *Config {
+	clone := &Config{
+		flat:          copyFlatMap(c.flat),
+		defaults:      copyFlatMap(c.defaults),
+		sources:       append([]sourceEntry(nil), c.sources...),
+		location:      c.location,
+		conflictError: c.conflictError,
+		observer:      c.observer,
+		tracer:        c.tracer,
+		mergeStrategy: c.mergeStrategy,
+		keyStrategies: c.keyStrategies,
+		separator:     c.separator,
+		decodeHooks:   append([]mapstructure.DecodeHookFunc(nil), c.decodeHooks...),
+		timeLayouts:   append([]string(nil), c.timeLayouts...),
+		listDelimiter: c.listDelimiter,
+		redactedKeys:  append([]string(nil), c.redactedKeys...),
+	}
+	if c.expectations != nil {
+		clone.expectations = make(map[string]reflect.Type, len(c.expectations))
+		for key, t := range c.expectations {
+			clone.expectations[key] = t
+		}
+	}
+	if c.history != nil {
+		clone.history = make(map[string][]string, len(c.history))
+		for key, names := range c.history {
+			clone.history[key] = append([]string(nil), names...)
+		}
+	}
+	return clone
+}
+
+func readFileLimited(path string, max int64) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, notFoundError(err)
+	}
+	defer f.Close()
+	return readAllLimited(f, max)
+}
+
+// readAllLimited reads r to the end, failing if there are more than max bytes (if max > 0).
+func readAllLimited(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return ioutil.ReadAll(r)
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(buf)) > max {
+		return nil, fmt.Errorf("config too large: more than %d bytes", max)
+	}
+	return buf, nil
+}
+
+// apply returns the flat map resulting of s overriding a copy of flat.
+func (c *Config) apply(ctx context.Context, flat map[string]interface{}, s Source) (map[string]interface{}, error) {
+	ctx, span := c.startSpan(ctx, s)
+	start := time.Now()
+	applied, err := c.override(ctx, flat, s)
+	c.observe(span, s, flat, applied, time.Since(start), err)
+	return applied, err
+}
+
+func (c *Config) override(ctx context.Context, flat map[string]interface{}, s Source) (map[string]interface{}, error) {
+	if step, ok := s.(*stepSource); ok {
+		return step.fn(c, copyFlatMap(flat))
+	}
+	var applied map[string]interface{}
+	var err error
+	if cs, ok := s.(ContextSource); ok {
+		applied, err = cs.OverrideContext(contextWithSeparator(ctx, c.sep()), copyFlatMap(flat))
+	} else {
+		applied, err = s.Override(copyFlatMap(flat))
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.mergeLists(flat, applied)
+	dropStaleElements(flat, applied, c.sep())
+	if c.conflictError {
+		var conflicts []string
+		for key, value := range flat {
+			if newValue, ok := applied[key]; ok && !reflect.DeepEqual(value, newValue) {
+				conflicts = append(conflicts, fmt.Sprintf("%s (%v then %v)", key, value, newValue))
+			}
+		}
+		if len(conflicts) > 0 {
+			sort.Strings(conflicts)
+			return nil, fmt.Errorf("conflicting values for %s", strings.Join(conflicts, ", "))
+		}
+	}
+	if err := c.checkExpectations(applied); err != nil {
+		return nil, err
+	}
+	return applied, nil
+}
+
+func copyFlatMap(fm map[string]interface{}) map[string]interface{} {
+	cfm := make(map[string]interface{}, len(fm))
+	for key, value := range fm {
+		cfm[key] = value
+	}
+	return cfm
+}
+
 // ToFlatMap returns a flat map of the keys and values in the config.
+// Defaults registered with SetDefault are included for keys no source set.
+// It is a copy, that the caller may modify.
 func (c *Config) ToFlatMap() map[string]interface{} {
-	return c.flat
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if len(c.defaults) == 0 {
+		return copyFlatMap(c.flat)
+	}
+	return c.flatMap()
+}
+
+// snapshot returns the flat map of the config, which must not be modified.
+// It is kept as is by the modifications, so it can be read once unlocked.
+func (c *Config) snapshot() map[string]interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.flatMap()
+}
+
+// flatMap is like snapshot, but the config must be locked.
+func (c *Config) flatMap() map[string]interface{} {
+	if len(c.defaults) == 0 {
+		return c.flat
+	}
+	fm := make(map[string]interface{}, len(c.defaults)+len(c.flat))
+	for key, value := range c.defaults {
+		fm[key] = value
+	}
+	for key, value := range c.flat {
+		fm[key] = value
+	}
+	return fm
 }
 
 // ToHierarchicalMap returns the keys and values in the config in a hierarchical map,
 // so when repeating config path are agglomerated (think JSON).
+// Its maps are copies, but its other values, like lists and the maps in them,
+// are shared with the config, and must not be modified; see AllSettings.
 func (c *Config) ToHierarchicalMap() map[string]interface{} {
-	return unflatten(c.ToFlatMap(), dotSlicer)
+	return copyTree(c.hierarchical())
+}
+
+// AllSettings is like ToHierarchicalMap, but returns a deep copy, sharing
+// no map or list with the config, that the caller may modify at will.
+func (c *Config) AllSettings() map[string]interface{} {
+	return deepCopyValue(reflect.ValueOf(c.hierarchical())).Interface().(map[string]interface{})
+}
+
+// hierarchical returns the config as an hierarchical map, built once
+// until the config changes; it must not be modified.
+func (c *Config) hierarchical() map[string]interface{} {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.treeMu.Lock()
+	defer c.treeMu.Unlock()
+	if c.tree == nil {
+		c.tree = unflatten(c.flatMap(), slicer(c.sep()))
+	}
+	return c.tree
+}
+
+func (c *Config) hasTree() bool {
+	c.treeMu.Lock()
+	defer c.treeMu.Unlock()
+	return c.tree != nil
+}
+
+// invalidateTree drops the hierarchical map, after the config changed.
+// The config must be locked, so no reader is building the map meanwhile.
+func (c *Config) invalidateTree() {
+	c.treeMu.Lock()
+	c.tree = nil
+	c.treeMu.Unlock()
+}
+
+// branch returns the hierarchical map under the dotted prefix of tree, which may be empty.
+// A component of prefix may be the index of an element of a list, like servers.0.
+func branch(tree map[string]interface{}, prefix string, sep string) map[string]interface{} {
+	if prefix == "" {
+		return tree
+	}
+	var node interface{} = tree
+	for _, key := range slicer(sep)(prefix) {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			node = n[key]
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || !isIndex(key) || i >= len(n) {
+				return map[string]interface{}{}
+			}
+			node = n[i]
+		default:
+			return map[string]interface{}{}
+		}
+	}
+	sub, ok := node.(map[string]interface{})
+	if !ok {
+		return map[string]interface{}{}
+	}
+	return sub
+}
+
+// copyTree returns a copy of the maps of tree, sharing their other values.
+func copyTree(tree map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(tree))
+	for key, value := range tree {
+		if sub, ok := value.(map[string]interface{}); ok {
+			value = copyTree(sub)
+		}
+		copied[key] = value
+	}
+	return copied
+}
+
+// Bytes returns the keys and values in the config as an hierarchical
+// document in the given format (json, yaml, cbor or any registered one).
+// It is the counterpart of NewBufSource.
+func (c *Config) Bytes(format string) ([]byte, error) {
+	return writeBuf(c.ToHierarchicalMap(), strings.ToLower(format))
+}
+
+// ToJSON returns the keys and values in the config as an indented,
+// hierarchical JSON document, with its keys in sorted order.
+// It is the counterpart of NewBufSource(buf, "json"), and is Bytes("json"),
+// so it uses the func registered with RegisterMarshalFunc for json, if any.
+func (c *Config) ToJSON() ([]byte, error) {
+	return c.Bytes("json")
+}
+
+// ToJSONString is like ToJSON, but returns a string.
+func (c *Config) ToJSONString() (string, error) {
+	buf, err := c.ToJSON()
+	return string(buf), err
+}
+
+// ToYAML returns the keys and values in the config as an hierarchical
+// YAML document, with its keys in sorted order, so outputs can be diffed.
+// It is the counterpart of NewBufSource(buf, "yaml"), and is Bytes("yaml"),
+// so it uses the func registered with RegisterMarshalFunc for yaml, if any.
+func (c *Config) ToYAML() ([]byte, error) {
+	return c.Bytes("yaml")
+}
+
+// WriteToFile writes the keys and values in the config to the file at path,
+// as an hierarchical document in the format of its extension (.json, .yaml, .yml,
+// .cbor, .hcl, .properties or any registered one), like Bytes.
+// As the config may hold secrets, the file is only readable by its owner.
+// It is written to a temporary file first, then renamed, so a reader
+// never sees a partially written file.
+func (c *Config) WriteToFile(path string) error {
+	buf, err := c.Bytes(strings.TrimPrefix(filepath.Ext(path), "."))
+	if err != nil {
+		return fmt.Errorf("cannot write %s: %w", path, err)
+	}
+	if err := writeFileAtomic(path, buf, 0600); err != nil {
+		return fmt.Errorf("cannot write %s: %w", path, err)
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, buf []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(buf)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// MarshalJSON returns the config as an hierarchical JSON document,
+// so a config can be embedded in a larger JSON document.
+func (c *Config) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.ToHierarchicalMap())
+}
+
+// UnmarshalJSON loads the JSON document buf into the config,
+// as AddSource would with a json buf source. It also works on
+// a zero Config, like one embedded in a struct being unmarshalled.
+func (c *Config) UnmarshalJSON(buf []byte) error {
+	c.lock()
+	if c.flat == nil {
+		c.flat = make(map[string]interface{})
+	}
+	if c.defaults == nil {
+		c.defaults = make(map[string]interface{})
+	}
+	if c.location == nil {
+		c.location = time.UTC
+	}
+	c.unlock()
+	return c.AddSource(NewBufSource(buf, "json"))
+}
+
+// Len returns the number of keys in the config, defaults included.
+func (c *Config) Len() int {
+	return len(c.snapshot())
+}
+
+// IsEmpty returns whether the config has no key at all.
+func (c *Config) IsEmpty() bool {
+	return c.Len() == 0
+}
+
+// String returns a summary of the config that never includes
+// any value, so a config can safely end up in logs.
+// Use Redacted, or DumpVerbose, to get the values.
+func (c *Config) String() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return fmt.Sprintf("gonfic.Config{keys: %d, sources: %d}", len(c.flatMap()), len(c.sources))
+}
+
+// DumpVerbose returns every key and value in the config, one key=value per line,
+// in sorted key order. Be careful, it includes secrets.
+func (c *Config) DumpVerbose() string {
+	var b strings.Builder
+	c.Walk(func(key string, value interface{}) {
+		fmt.Fprintf(&b, "%s=%v\n", key, value)
+	})
+	return b.String()
+}
+
+// Walk calls fn for every key and value in the config, in sorted key order.
+func (c *Config) Walk(fn func(key string, value interface{})) {
+	fm := c.snapshot()
+	keys := make([]string, 0, len(fm))
+	for key := range fm {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fn(key, fm[key])
+	}
+}
+
+// Has returns whether key is set, looked up as by Get.
+func (c *Config) Has(key string) bool {
+	_, ok := c.Get(key)
+	return ok
+}
+
+// Keys returns every key in the config, in sorted order.
+// A list is a single key, like in the flat map: its elements,
+// which Get addresses by index (like servers.1.host), are not listed.
+func (c *Config) Keys() []string {
+	return c.KeysWithPrefix("")
+}
+
+// KeysWithPrefix returns, in sorted order, the keys under prefix
+// (like "database.host" for the prefix "database"), or every key if prefix is empty.
+func (c *Config) KeysWithPrefix(prefix string) []string {
+	prefix = c.keyPrefix(prefix)
+	keys := []string{}
+	c.Walk(func(key string, value interface{}) {
+		if prefix == "" || strings.HasPrefix(key, prefix+c.sep()) {
+			keys = append(keys, key)
+		}
+	})
+	return keys
+}
+
+// WalkHierarchical is like Walk, but gives fn the key as a path of its components.
+func (c *Config) WalkHierarchical(fn func(path []string, value interface{})) {
+	c.Walk(func(key string, value interface{}) {
+		fn(slicer(c.sep())(key), value)
+	})
+}
+
+// Sub returns a new config holding the keys (and defaults) under prefix,
+// with prefix removed, so "database.host" is "host" in c.Sub("database").
+// It is empty, not nil, if there is no key under prefix.
+// The sub config has no sources, but explains its keys as c does.
+func (c *Config) Sub(prefix string) *Config {
+	prefix = c.keyPrefix(prefix)
+	sub := NewConfig(WithLocation(c.location), WithSeparator(c.separator))
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	sub.decodeHooks = append([]mapstructure.DecodeHookFunc(nil), c.decodeHooks...)
+	sub.timeLayouts = append([]string(nil), c.timeLayouts...)
+	sub.listDelimiter = c.listDelimiter
+	sub.flat = copyFlatMap(subFlatMap(c.flat, prefix, c.sep()))
+	sub.defaults = copyFlatMap(subFlatMap(c.defaults, prefix, c.sep()))
+	for key := range sub.flat {
+		full := key
+		if prefix != "" {
+			full = prefix + c.sep() + key
+		}
+		if names, ok := c.history[full]; ok {
+			if sub.history == nil {
+				sub.history = make(map[string][]string)
+			}
+			sub.history[key] = append([]string(nil), names...)
+		}
+	}
+	return sub
 }
 
 // Unmarshal the keys and values as an hierarchical map
 // and stores the result in the value pointed to by v.
 // if prefix is not empty, only the prefixed keys will be
 // unmarshal.
-func (c *Config) Unmarshal(prefix string, v interface{}) error {
-	pfm := c.ToFlatMap()
-	fm := pfm
-	if prefix != "" {
-		fm := make(map[string]interface{}, len(pfm))
-		for key, value := range pfm {
-			if !strings.HasPrefix(key, prefix+".") {
-				continue
+func (c *Config) Unmarshal(prefix string, v interface{}, opts ...UnmarshalOption) error {
+	o := &unmarshalOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return c.unmarshal(prefix, v, o)
+}
+
+// UnmarshalKeyStrict is like Unmarshal with the key prefix,
+// but without weak typing (a string will not be decoded unto an int),
+// and with every key under key required to match a field of v.
+// It is useful when a subsystem config must match its struct exactly.
+func (c *Config) UnmarshalKeyStrict(key string, v interface{}) error {
+	return c.unmarshal(key, v, &unmarshalOptions{strictTypes: true, errorUnused: true})
+}
+
+// UnmarshalStrict is like Unmarshal, except that it fails, listing them,
+// if some keys under prefix match no field of v, like a typo in a config file.
+// Unlike UnmarshalKeyStrict, types are still weakly decoded.
+func (c *Config) UnmarshalStrict(prefix string, v interface{}, opts ...UnmarshalOption) error {
+	return c.Unmarshal(prefix, v, append(opts, WithErrorUnused())...)
+}
+
+// WithErrorUnused makes Unmarshal fail if some keys match no field.
+func WithErrorUnused() UnmarshalOption {
+	return func(o *unmarshalOptions) {
+		o.errorUnused = true
+	}
+}
+
+// UnmarshalWithDefaults is like UnmarshalKeyWithDefaults for the whole config.
+func (c *Config) UnmarshalWithDefaults(defaults interface{}, v interface{}) error {
+	return c.UnmarshalKeyWithDefaults("", defaults, v)
+}
+
+// UnmarshalKeyWithDefaults first sets the value pointed to by v to a deep copy of defaults
+// (a value or a pointer of the same type), then unmarshals the keys under key unto it,
+// so the defaults survive for the keys the config does not set.
+func (c *Config) UnmarshalKeyWithDefaults(key string, defaults interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("cannot unmarshal unto non pointer %T", v)
+	}
+	dv := reflect.Indirect(reflect.ValueOf(defaults))
+	if !dv.IsValid() || !dv.Type().AssignableTo(rv.Elem().Type()) {
+		return fmt.Errorf("cannot use defaults %T for %T", defaults, v)
+	}
+	rv.Elem().Set(deepCopyValue(dv))
+	return c.Unmarshal(key, v)
+}
+
+// deepCopyValue returns a copy of v that shares no pointer, map or slice with it.
+func deepCopyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type().Elem())
+		c.Elem().Set(deepCopyValue(v.Elem()))
+		return c
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.New(v.Type()).Elem()
+		c.Set(deepCopyValue(v.Elem()))
+		return c
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeMapWithSize(v.Type(), v.Len())
+		for _, key := range v.MapKeys() {
+			c.SetMapIndex(key, deepCopyValue(v.MapIndex(key)))
+		}
+		return c
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		c := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopyValue(v.Index(i)))
+		}
+		return c
+	case reflect.Array:
+		c := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			c.Index(i).Set(deepCopyValue(v.Index(i)))
+		}
+		return c
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if c.Field(i).CanSet() {
+				c.Field(i).Set(deepCopyValue(v.Field(i)))
 			}
-			key = strings.TrimPrefix(key, prefix+".")
-			fm[key] = value
 		}
+		return c
+	}
+	return v
+}
+
+func (c *Config) unmarshal(prefix string, v interface{}, o *unmarshalOptions) error {
+	prefix = c.keyPrefix(prefix)
+	var m map[string]interface{}
+	if o.branchOnly && !c.hasTree() {
+		m = unflatten(subFlatMap(c.snapshot(), prefix, c.sep()), slicer(c.sep()))
+	} else {
+		m = copyTree(branch(c.hierarchical(), prefix, c.sep()))
+	}
+	err := c.decodeWith(m, v, o)
+	if err != nil {
+		return err
+	}
+	if o.constraints {
+		return checkConstraints(v)
 	}
-	m := unflatten(fm, dotSlicer)
+	return nil
+}
+
+// decode weakly decodes input unto output, the way Unmarshal does.
+func (c *Config) decode(input interface{}, output interface{}) error {
+	return c.decodeWith(input, output, &unmarshalOptions{})
+}
+
+func (c *Config) decodeWith(input interface{}, output interface{}, o *unmarshalOptions) error {
 	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
-		DecodeHook:       decodeHook,
-		WeaklyTypedInput: true,
-		Result:           v,
+		DecodeHook:       c.composedDecodeHook(),
+		WeaklyTypedInput: !o.strictTypes,
+		ErrorUnused:      o.errorUnused,
+		Result:           output,
 	})
 	if err != nil {
 		return err
 	}
-	return dec.Decode(m)
+	return dec.Decode(input)
+}
+
+// keyPrefix returns prefix the way keys are stored, lowercased,
+// and without a trailing separator.
+func (c *Config) keyPrefix(prefix string) string {
+	return strings.TrimSuffix(strings.ToLower(prefix), c.sep())
+}
+
+// subFlatMap returns the keys of fm under prefix, with the prefix removed.
+func subFlatMap(fm map[string]interface{}, prefix string, sep string) map[string]interface{} {
+	if prefix == "" {
+		return fm
+	}
+	sfm := make(map[string]interface{})
+	for key, value := range fm {
+		if !strings.HasPrefix(key, prefix+sep) {
+			continue
+		}
+		sfm[strings.TrimPrefix(key, prefix+sep)] = value
+	}
+	return sfm
+}
+
+// UnmarshalOption alters the way Unmarshal decodes the config.
+type UnmarshalOption func(*unmarshalOptions)
+
+type unmarshalOptions struct {
+	constraints bool
+	strictTypes bool
+	errorUnused bool
+	branchOnly  bool
+}
+
+// WithBranchOnly makes Unmarshal build only the branch of the hierarchical map
+// under its prefix, rather than the hierarchical map of the whole config
+// (which is then kept until the config changes). It lowers the memory used
+// to read a small section of a large config, at the cost of going through
+// every key on each call. Once the whole map is built, it is used anyway.
+func WithBranchOnly() UnmarshalOption {
+	return func(o *unmarshalOptions) {
+		o.branchOnly = true
+	}
+}
+
+// AddDecodeHook adds hook to the hooks run by Unmarshal (and the getters)
+// on each value before decoding it, like a string unto a url.URL or an enum.
+// Hooks run in the order they were added, each one given the result of the
+// previous one, and before the built-in hook decoding durations, times and byte sizes,
+// which then only sees the values still needing it: a hook that returns
+// a time.Duration for a string overrides the built-in parsing of durations.
+// Like an Option, it must be called before the config is used concurrently.
+func (c *Config) AddDecodeHook(hook mapstructure.DecodeHookFunc) {
+	c.decodeHooks = append(c.decodeHooks, hook)
 }
 
-func decodeHook(srcType reflect.Type, dstType reflect.Type, v interface{}) (interface{}, error) {
+func (c *Config) composedDecodeHook() mapstructure.DecodeHookFunc {
+	if len(c.decodeHooks) == 0 {
+		return c.decodeHook
+	}
+	hooks := append(append([]mapstructure.DecodeHookFunc(nil), c.decodeHooks...), c.decodeHook)
+	return mapstructure.ComposeDecodeHookFunc(hooks...)
+}
+
+func (c *Config) decodeHook(srcType reflect.Type, dstType reflect.Type, v interface{}) (interface{}, error) {
+	if srcType == nil {
+		// a previous hook returned nil
+		return v, nil
+	}
 	// not sure this is the way to go
 	if srcType.Kind() == reflect.String && dstType.String() == "time.Duration" {
 		return time.ParseDuration(v.(string))
 	}
+	if srcType.Kind() == reflect.String && dstType.String() == "time.Time" {
+		return parseTime(v.(string), c.location, c.timeLayouts)
+	}
+	if isByteSize(srcType, dstType) {
+		if n, ok, err := parseByteSize(v.(string)); ok {
+			return n, err
+		}
+	}
+	if srcType.Kind() == reflect.Slice && dstType.Kind() == reflect.Map && dstType.Key().Kind() == reflect.String {
+		// a map whose keys are 0 to n-1 was made a list by unflatten
+		if list, ok := v.([]interface{}); ok {
+			return indexMap(list), nil
+		}
+	}
+	if isScalarToSlice(srcType, dstType) {
+		if s, ok := v.(string); ok {
+			// a list written as JSON, like ToEnv does
+			var list []interface{}
+			if strings.HasPrefix(strings.TrimSpace(s), "[") && json.Unmarshal([]byte(s), &list) == nil {
+				return list, nil
+			}
+			return c.splitList(s), nil
+		}
+		// "one or many" values, like hosts: a.com for a []string,
+		// even when strict types are asked for
+		return []interface{}{v}, nil
+	}
 	return v, nil
 }
 
+// splitList splits s on the list delimiter, trimming the elements.
+// An empty (or blank) s is an empty list.
+func (c *Config) splitList(s string) []interface{} {
+	delim := ","
+	if c.listDelimiter != nil {
+		delim = *c.listDelimiter
+	}
+	if strings.TrimSpace(s) == "" {
+		return []interface{}{}
+	}
+	if delim == "" {
+		return []interface{}{s}
+	}
+	parts := strings.Split(s, delim)
+	list := make([]interface{}, len(parts))
+	for i, part := range parts {
+		list[i] = strings.TrimSpace(part)
+	}
+	return list
+}
+
+func isScalarToSlice(srcType reflect.Type, dstType reflect.Type) bool {
+	if srcType == nil || dstType == nil || dstType.Kind() != reflect.Slice {
+		return false
+	}
+	switch srcType.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Map, reflect.Struct, reflect.Interface:
+		return false
+	case reflect.String:
+		// a string stays a string for a []byte
+		return dstType.Elem().Kind() != reflect.Uint8
+	}
+	return true
+}
+
+// zonelessTimeLayouts are the layouts tried, in the config location,
+// when a time is not in RFC 3339 format.
+var zonelessTimeLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"15:04:05",
+	"15:04",
+}
+
+func parseTime(s string, loc *time.Location, layouts []string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	if loc == nil {
+		loc = time.UTC
+	}
+	for _, layout := range append(append([]string(nil), layouts...), zonelessTimeLayouts...) {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse %q as a time", s)
+}
+
 type structSource struct {
 	prefix string
 	value  interface{}
@@ -100,19 +1267,28 @@ func NewStructSource(prefix string, value interface{}) Source {
 	return &structSource{prefix: prefix, value: value}
 }
 
+func (s *structSource) String() string {
+	return "struct"
+}
+
 func (s *structSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *structSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
 	buf, err := json.Marshal(s.value)
 	if err != nil {
 		return config, err
 	}
-	bufSource := NewBufSource(buf, "json")
-	fm, err := bufSource.Override(make(map[string]interface{}))
+	bufSource := &bufSource{buf: buf, ext: "json", opts: newSourceOptions(nil)}
+	fm, err := bufSource.OverrideContext(ctx, make(map[string]interface{}))
 	if err != nil {
 		return config, err
 	}
 	for key, value := range fm {
 		if s.prefix != "" {
-			key = s.prefix + "." + key
+			key = s.prefix + SeparatorFromContext(ctx) + key
 		}
 		key = strings.ToLower(key)
 		config[key] = value
@@ -120,124 +1296,562 @@ func (s *structSource) Override(config map[string]interface{}) (map[string]inter
 	return config, nil
 }
 
+type mapSource struct {
+	m map[string]interface{}
+}
+
+// NewMapSource returns a source that loads the keys and values of m,
+// which can be flat ({"db.port": 5432}), hierarchical ({"db": {"port": 5432}}),
+// or a mix of both. Values are used as they are, without going through JSON
+// like with NewStructSource.
+func NewMapSource(m map[string]interface{}) Source {
+	return &mapSource{m: m}
+}
+
+func (s *mapSource) String() string {
+	return "map"
+}
+
+func (s *mapSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *mapSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	sep := SeparatorFromContext(ctx)
+	// keys of m are keys, possibly with their separators, so they are not escaped
+	join := func(a []string) string { return strings.Join(a, sep) }
+	for key, value := range flatten(s.m, join) {
+		config[strings.ToLower(key)] = value
+	}
+	return config, nil
+}
+
+type tagDefaultsSource struct {
+	defaults []tagDefault
+}
+
+// tagDefault is the default value of the field at path.
+type tagDefault struct {
+	path  []string
+	value string
+}
+
+// NewTagDefaultsSource returns a source that sets, for each key not already set,
+// the value of the default struct tag of the matching field in structPtr, like
+//
+//	Port int `json:"port" default:"8080"`
+//
+// Keys are built from the json tag names (or the field names),
+// following nested structs and pointers to structs.
+func NewTagDefaultsSource(structPtr interface{}) Source {
+	var defaults []tagDefault
+	t := reflect.TypeOf(structPtr)
+	if t != nil {
+		defaults = collectTagDefaults(t, nil, defaults)
+	}
+	return &tagDefaultsSource{defaults: defaults}
+}
+
+func collectTagDefaults(t reflect.Type, path []string, defaults []tagDefault) []tagDefault {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return defaults
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" {
+			defaults = collectTagDefaults(f.Type, path, defaults)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		fieldPath := append(append([]string(nil), path...), strings.ToLower(name))
+		if value, ok := f.Tag.Lookup("default"); ok {
+			defaults = append(defaults, tagDefault{path: fieldPath, value: value})
+			continue
+		}
+		defaults = collectTagDefaults(f.Type, fieldPath, defaults)
+	}
+	return defaults
+}
+
+func (s *tagDefaultsSource) String() string {
+	return "tag defaults"
+}
+
+func (s *tagDefaultsSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *tagDefaultsSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	join := joiner(SeparatorFromContext(ctx))
+	for _, d := range s.defaults {
+		key := join(d.path)
+		if _, ok := config[key]; !ok {
+			config[key] = d.value
+		}
+	}
+	return config, nil
+}
+
 type envSource struct {
+	delim    string
+	prefix   string
+	sep      string
+	keepCase bool
+}
+
+// EnvOption alters the way the env source maps variable names to keys.
+type EnvOption func(*envSource)
+
+// NewEnvSource returns a source that loads every environment variable,
+// with its name lowercased and each _ replaced by the key separator of the config,
+// a dot by default (SERVER_PORT is server.port).
+// A double underscore stands for a literal underscore,
+// so SERVER_MAX__CONNS is server.max_conns.
+func NewEnvSource(opts ...EnvOption) Source {
+	s := &envSource{delim: "_"}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
-func NewEnvSource() Source {
-	return &envSource{}
+// WithEnvNestingDelimiter sets the delimiter that separates the key components
+// in variable names. Any delimiter other than the default _ is replaced by the key separator,
+// and every underscore is then kept literally: with "__",
+// SERVER__MAX_CONNS is server.max_conns.
+func WithEnvNestingDelimiter(delim string) EnvOption {
+	return func(s *envSource) {
+		s.delim = delim
+	}
+}
+
+// NewEnvSourceWithPrefix returns a source like NewEnvSource, that only loads the
+// variables whose name starts with prefix followed by the nesting delimiter
+// (MYAPP_ for the prefix MYAPP), with that start removed from the name:
+// MYAPP_SERVER_PORT is server.port. The prefix is matched regardless of case,
+// and the rest of the name is then mapped to a key as by NewEnvSource,
+// with each delimiter replaced by the key separator of the config.
+func NewEnvSourceWithPrefix(prefix string, opts ...EnvOption) Source {
+	s := NewEnvSource(opts...).(*envSource)
+	s.prefix = prefix
+	return s
+}
+
+// WithEnvKeySeparator sets the separator each nesting delimiter is replaced by,
+// instead of the key separator of the config.
+func WithEnvKeySeparator(sep string) EnvOption {
+	return func(s *envSource) {
+		s.sep = sep
+	}
+}
+
+// WithEnvKeepCase keeps the variable names case in the keys,
+// instead of lowercasing them: SERVER_PORT is SERVER.PORT.
+func WithEnvKeepCase() EnvOption {
+	return func(s *envSource) {
+		s.keepCase = true
+	}
+}
+
+func (s *envSource) String() string {
+	if s.prefix != "" {
+		return "env:" + s.prefix
+	}
+	return "env"
 }
 
 func (s *envSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *envSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	sep := s.sep
+	if sep == "" {
+		sep = SeparatorFromContext(ctx)
+	}
 	for _, env := range os.Environ() {
 		pair := strings.SplitN(env, "=", 2)
 		key, value := pair[0], pair[1]
-		key = strings.ToLower(key)
-		key = strings.Replace(key, "_", ".", -1)
-		config[key] = value
+		if s.prefix != "" {
+			start := s.prefix + s.delim
+			if len(key) <= len(start) || !strings.EqualFold(key[:len(start)], start) {
+				continue
+			}
+			key = key[len(start):]
+		}
+		config[s.key(key, sep)] = value
 	}
 	return config, nil
 }
 
+func (s *envSource) key(name string, sep string) string {
+	if !s.keepCase {
+		name = strings.ToLower(name)
+	}
+	if s.delim != "_" {
+		return strings.Replace(name, s.delim, sep, -1)
+	}
+	parts := strings.Split(name, "__")
+	for i, part := range parts {
+		parts[i] = strings.Replace(part, "_", sep, -1)
+	}
+	return strings.Join(parts, "_")
+}
+
+// ToEnv returns the keys and values in the config as sorted KEY=VALUE strings,
+// suitable for the environment of a child process.
+// Each key is uppercased, with its separators replaced by _ and its literal underscores doubled,
+// and prefixed by prefix and _ when prefix is not empty.
+// List values are written as JSON, which Unmarshal and the getters decode
+// back into a slice. This is the inverse of NewEnvSource: loading the result
+// with NewEnvSource gives back the config under the lowercased prefix.
+func (c *Config) ToEnv(prefix string) []string {
+	var env []string
+	c.Walk(func(key string, value interface{}) {
+		name := strings.ToUpper(strings.Replace(strings.Replace(key, "_", "__", -1), c.sep(), "_", -1))
+		if prefix != "" {
+			name = strings.ToUpper(prefix) + "_" + name
+		}
+		str, err := scalarString(value)
+		if err != nil {
+			str = fmt.Sprint(value)
+		}
+		env = append(env, name+"="+str)
+	})
+	return env
+}
+
 type fileSource struct {
-	path string
+	path     string
+	ext      string
+	optional bool
+	opts     sourceOptions
 }
 
-func NewFileSource(path string) Source {
-	return &fileSource{path: path}
+func NewFileSource(path string, opts ...SourceOption) Source {
+	return &fileSource{path: path, opts: newSourceOptions(opts)}
+}
+
+func (s *fileSource) String() string {
+	return "file:" + s.path
 }
 
 func (s *fileSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
-	buf, err := ioutil.ReadFile(s.path)
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *fileSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	buf, err := readFileLimited(s.path, s.opts.maxBytes)
+	if err != nil && s.optional && errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
 	if err != nil {
-		return nil, fmt.Errorf("cannot read: %s", err)
+		return nil, fmt.Errorf("cannot read: %w", err)
 	}
-	ext := filepath.Ext(s.path)
-	if strings.HasPrefix(ext, ".") {
-		ext = strings.TrimPrefix(ext, ".")
+	ext := s.ext
+	if ext == "" {
+		ext = strings.TrimPrefix(filepath.Ext(s.path), ".")
 	}
-	bufSource := NewBufSource(buf, ext)
-	return bufSource.Override(config)
+	bufSource := &bufSource{buf: buf, ext: strings.ToLower(ext), path: s.path, opts: s.opts}
+	config, err = bufSource.OverrideContext(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.path, err)
+	}
+	return config, nil
 }
 
-type bufSource struct {
-	buf []byte
-	ext string
+// NewOptionalFileSource returns a source like NewFileSource,
+// except that a file that does not exist leaves the config unchanged.
+// Any other read error (like a permission denied), or a parse error,
+// including a missing included file, is still returned.
+func NewOptionalFileSource(path string, opts ...SourceOption) Source {
+	return &fileSource{path: path, optional: true, opts: newSourceOptions(opts)}
 }
 
-func NewBufSource(buf []byte, ext string) Source {
-	return &bufSource{buf: buf, ext: strings.ToLower(ext)}
+type envOverlaySource struct {
+	base string
+	env  string
+	opts []SourceOption
 }
 
-func (s *bufSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
-	fm, err := readBuf(s.buf, s.ext)
+// NewEnvOverlaySource returns a source that loads the base file,
+// then, if env is not empty, overlays the file named after base with env
+// inserted before its extension (config.yaml then config.production.yaml).
+// A missing overlay file is not an error.
+func NewEnvOverlaySource(base string, env string, opts ...SourceOption) Source {
+	return &envOverlaySource{base: base, env: env, opts: opts}
+}
+
+func (s *envOverlaySource) String() string {
+	return "file:" + s.base + "+" + s.env
+}
+
+func (s *envOverlaySource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *envOverlaySource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	base := &fileSource{path: s.base, opts: newSourceOptions(s.opts)}
+	config, err := base.OverrideContext(ctx, config)
 	if err != nil {
-		return config, err
+		return nil, err
 	}
-	for key, value := range fm {
-		key = strings.ToLower(key)
-		config[key] = value
+	if s.env == "" {
+		return config, nil
 	}
-	return config, nil
+	ext := filepath.Ext(s.base)
+	path := strings.TrimSuffix(s.base, ext) + "." + s.env + ext
+	overlay := &fileSource{path: path, optional: true, opts: newSourceOptions(s.opts)}
+	return overlay.OverrideContext(ctx, config)
+}
+
+type stdinSource struct {
+	ext    string
+	opts   []SourceOption
+	mu     sync.Mutex
+	reader *readerSource
+}
+
+// NewStdinSource returns a source that reads the whole standard input
+// and parses it according to ext. If standard input is a terminal
+// rather than a pipe or a file, it fails instead of waiting for input.
+// Standard input is read once: reloading the config reuses its content.
+func NewStdinSource(ext string, opts ...SourceOption) Source {
+	return &stdinSource{ext: ext, opts: opts}
+}
+
+func (s *stdinSource) String() string {
+	return "stdin"
+}
+
+func (s *stdinSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
 }
 
-func readBuf(buf []byte, ext string) (map[string]interface{}, error) {
-	var fn func([]byte) (map[string]interface{}, error)
-	switch ext {
-	case "js", "json":
-		fallthrough
-	case "yml", "yaml":
-		fn = readYaml
-		break
-	default:
-		return nil, fmt.Errorf("%s is not a valid yaml or json extension", ext)
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *stdinSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	s.mu.Lock()
+	if s.reader == nil {
+		fi, err := os.Stdin.Stat()
+		if err != nil {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("cannot stat stdin: %w", err)
+		}
+		if fi.Mode()&os.ModeCharDevice != 0 {
+			s.mu.Unlock()
+			return nil, fmt.Errorf("no input on stdin")
+		}
+		s.reader = &readerSource{r: os.Stdin, name: "stdin", ext: s.ext, opts: newSourceOptions(s.opts)}
 	}
-	fm, err := fn(buf)
+	reader := s.reader
+	s.mu.Unlock()
+	return reader.OverrideContext(ctx, config)
+}
+
+type readerSource struct {
+	r    io.Reader
+	name string
+	ext  string
+	opts sourceOptions
+	mu   sync.Mutex
+	read bool
+	buf  []byte
+}
+
+// NewReaderSource returns a source that reads r to the end,
+// like an HTTP response body or a pipe, and parses it according to ext.
+// As r is drained once read, its content is kept: reloading the config
+// (with ReplaceSource, Rebuild or Watch) reuses it rather than reading r again.
+func NewReaderSource(r io.Reader, ext string, opts ...SourceOption) Source {
+	return &readerSource{r: r, name: "reader", ext: ext, opts: newSourceOptions(opts)}
+}
+
+func (s *readerSource) String() string {
+	return s.name + ":" + strings.ToLower(s.ext)
+}
+
+func (s *readerSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *readerSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	buf, err := s.content()
 	if err != nil {
-		return nil, fmt.Errorf("cannot parse %s buf: %s", ext, err)
+		return nil, fmt.Errorf("cannot read %s: %w", s.name, err)
 	}
-	return fm, nil
+	bufSource := &bufSource{buf: buf, ext: strings.ToLower(s.ext), opts: s.opts}
+	return bufSource.OverrideContext(ctx, config)
+}
+
+// content returns the content of r, read on the first call only.
+func (s *readerSource) content() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.read {
+		buf, err := readAllLimited(s.r, s.opts.maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		s.read, s.buf = true, buf
+	}
+	return s.buf, nil
+}
+
+type bufSource struct {
+	buf  []byte
+	ext  string
+	path string
+	opts sourceOptions
+}
+
+func NewBufSource(buf []byte, ext string, opts ...SourceOption) Source {
+	return &bufSource{buf: buf, ext: strings.ToLower(ext), opts: newSourceOptions(opts)}
 }
 
-func readJson(buf []byte) (map[string]interface{}, error) {
-	return readUnmarshalableBuf(buf, json.Unmarshal)
+func (s *bufSource) String() string {
+	return "buf:" + s.ext
 }
 
-func readYaml(buf []byte) (map[string]interface{}, error) {
-	return readUnmarshalableBuf(buf, yaml.Unmarshal)
+func (s *bufSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
 }
 
-func readUnmarshalableBuf(buf []byte, unmarshal func([]byte, interface{}) error) (map[string]interface{}, error) {
-	m := make(map[string]interface{})
-	err := unmarshal(buf, &m)
+// OverrideContext is like Override, with the key separator of ctx.
+func (s *bufSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	var fm map[string]interface{}
+	var err error
+	if s.opts.includes {
+		fm, err = readBufWithIncludes(s.buf, s.ext, s.path, s.opts.maxBytes, SeparatorFromContext(ctx))
+	} else {
+		fm, err = readBuf(s.buf, s.ext, SeparatorFromContext(ctx))
+	}
 	if err != nil {
-		return nil, fmt.Errorf("cannot unmarshall: %s", err)
+		return config, err
+	}
+	for key, value := range fm {
+		key = strings.ToLower(key)
+		config[key] = value
 	}
-	fm := flatten(m, dotJoiner)
-	return fm, nil
+	return config, nil
 }
 
 var dotJoiner = func(a []string) string { return strings.Join(a, ".") }
 
 var dotSlicer = func(s string) []string { return strings.Split(s, ".") }
 
+// unflatten builds the hierarchical map of flatmap. An indexed key,
+// like servers.1.host, overrides the element of the list under servers.
+// A map whose keys are exactly 0 to n-1, like plugins.0 and plugins.1,
+// is a list, and otherwise (a sparse index, or mixed keys) it is a map.
 func unflatten(flatmap map[string]interface{}, slicer func(string) []string) map[string]interface{} {
 	var unflatmap = make(map[string]interface{})
-	for flatkey, value := range flatmap {
+	flatkeys := make([]string, 0, len(flatmap))
+	for flatkey := range flatmap {
+		flatkeys = append(flatkeys, flatkey)
+	}
+	// in sorted order, a (possibly nil) leaf comes before the keys under it,
+	// which then replace it with a map instead of panicking
+	sort.Strings(flatkeys)
+	// the maps made for the keys, and the lists turned into maps
+	// by indexed keys, parents first
+	type node struct {
+		parent map[string]interface{}
+		key    string
+	}
+	var nodes []node
+	for _, flatkey := range flatkeys {
 		keys := slicer(flatkey)
 		subunflatmap := unflatmap
 		for _, key := range keys[:len(keys)-1] {
-			node, ok := subunflatmap[key]
+			sub, ok := subunflatmap[key].(map[string]interface{})
 			if !ok {
-				node = make(map[string]interface{})
-				subunflatmap[key] = node
+				sub = make(map[string]interface{})
+				if list, ok := subunflatmap[key].([]interface{}); ok {
+					sub = indexMap(list)
+				}
+				subunflatmap[key] = sub
+				nodes = append(nodes, node{parent: subunflatmap, key: key})
 			}
-			subunflatmap = node.(map[string]interface{})
+			subunflatmap = sub
+		}
+		subunflatmap[keys[len(keys)-1]] = flatmap[flatkey]
+	}
+	// children first, so a list holds its elements once they are lists again
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := nodes[i]
+		if m, ok := n.parent[n.key].(map[string]interface{}); ok {
+			n.parent[n.key] = listify(m)
 		}
-		subunflatmap[keys[len(keys)-1]] = value
 	}
 	return unflatmap
 }
 
+// indexMap returns the elements of list keyed by their index,
+// with the maps among them copied so they can be modified.
+func indexMap(list []interface{}) map[string]interface{} {
+	m := make(map[string]interface{}, len(list))
+	for i, elem := range list {
+		if sub, ok := elem.(map[string]interface{}); ok {
+			elem = copyTree(sub)
+		}
+		m[strconv.Itoa(i)] = elem
+	}
+	return m
+}
+
+// listify returns m as a list if its keys are exactly 0 to len(m)-1.
+func listify(m map[string]interface{}) interface{} {
+	if len(m) == 0 {
+		return m
+	}
+	list := make([]interface{}, len(m))
+	for key, value := range m {
+		if !isIndex(key) {
+			return m
+		}
+		i, err := strconv.Atoi(key)
+		if err != nil || i >= len(m) {
+			return m
+		}
+		list[i] = value
+	}
+	return list
+}
+
+// isIndex reports whether key is a list index, like 0 or 12 (but not 01 or -1).
+func isIndex(key string) bool {
+	if key == "" || (len(key) > 1 && key[0] == '0') {
+		return false
+	}
+	for _, r := range key {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// flatten builds the flat map of unflatmap. A list stays a single value,
+// rather than a key for each element, so that the merge strategies apply
+// to the whole list; Get still addresses its elements by index.
 func flatten(unflatmap map[string]interface{}, joiner func([]string) string) map[string]interface{} {
 	var flatmap = make(map[string]interface{})
 	flattenrec(unflatmap, []string{}, func(keys []string, value interface{}) {
@@ -248,7 +1862,10 @@ func flatten(unflatmap map[string]interface{}, joiner func([]string) string) map
 
 func flattenrec(unflatmap map[string]interface{}, keys []string, adder func(keys []string, value interface{})) {
 	for key, value := range unflatmap {
-		subkeys := append(keys, key)
+		// copy keys, so no branch shares (and overwrites) the path of another
+		subkeys := make([]string, len(keys)+1)
+		copy(subkeys, keys)
+		subkeys[len(keys)] = key
 		if subunflatmap, ok := value.(map[string]interface{}); ok {
 			flattenrec(subunflatmap, subkeys, adder)
 		} else {
@@ -1,8 +1,31 @@
 package gonfic
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"github.com/fxamacker/cbor/v2"
+	"github.com/ghodss/yaml"
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/pflag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -59,6 +82,34 @@ func TestYAML(t *testing.T) {
 	test(t, buf, "yaml")
 }
 
+func TestCBOR(t *testing.T) {
+	buf, err := cbor.Marshal(map[string]interface{}{
+		"values": map[string]interface{}{
+			"v1": map[string]interface{}{
+				"b": true,
+				"s": []byte("hello world"),
+				"i": -42,
+				"u": uint64(42),
+				"f": 3.1416,
+				"m": map[string]interface{}{"k1": "v1"},
+				"a": []interface{}{"e1"},
+				"d": "1m",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("unable to marshal cbor: %s", err)
+	}
+	test(t, string(buf), "cbor")
+	c := NewConfig()
+	c.AddSource(NewBufSource(buf, "cbor"))
+	v := new(testConfig)
+	c.Unmarshal("", v)
+	if v1 := v.Values["v1"]; v1 == nil || v1.S != "hello world" || v1.I != -42 || v1.U != 42 || v1.D != time.Minute {
+		t.Errorf("unexpected cbor values: %#v", v1)
+	}
+}
+
 func TestStruct(t *testing.T) {
 	in := testConfig{Values: map[string]*testValue{"v1": {S: "hello world"}}}
 	c := NewConfig()
@@ -84,3 +135,2768 @@ func test(t *testing.T, buf string, ext string) {
 	}
 	fmt.Printf("%#v", v)
 }
+
+func TestRebuild(t *testing.T) {
+	c := NewConfig()
+	err := c.AddSource(NewBufSource([]byte(`{"a": 1, "b": 2}`), "json"))
+	if err != nil {
+		t.Fatalf("unable to add buf source: %s", err)
+	}
+	err = c.Rebuild(NewBufSource([]byte(`{"a": 3}`), "json"))
+	if err != nil {
+		t.Fatalf("unable to rebuild: %s", err)
+	}
+	fm := c.ToFlatMap()
+	if _, ok := fm["b"]; ok {
+		t.Errorf("stale key b should have been removed: %v", fm)
+	}
+	if fm["a"] != 3.0 {
+		t.Errorf("a should be 3, got %v", fm["a"])
+	}
+	err = c.Rebuild(NewBufSource([]byte(`{`), "json"))
+	if err == nil {
+		t.Errorf("rebuild with a broken source should fail")
+	}
+	if c.ToFlatMap()["a"] != 3.0 {
+		t.Errorf("failed rebuild should leave the config untouched")
+	}
+	c.Reset()
+	if len(c.ToFlatMap()) != 0 {
+		t.Errorf("reset should clear the config")
+	}
+}
+
+func TestEnvOverlay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(base, []byte("a: 1\nb: 2"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "config.production.yaml"), []byte("b: 3"), 0644)
+	c := NewConfig()
+	err = c.AddSource(NewEnvOverlaySource(base, "production"))
+	if err != nil {
+		t.Fatalf("unable to add overlay source: %s", err)
+	}
+	fm := c.ToFlatMap()
+	if fm["a"] != 1.0 || fm["b"] != 3.0 {
+		t.Errorf("overlay not applied: %v", fm)
+	}
+	c = NewConfig()
+	err = c.AddSource(NewEnvOverlaySource(base, "staging"))
+	if err != nil {
+		t.Fatalf("missing overlay should not fail: %s", err)
+	}
+	if c.ToFlatMap()["b"] != 2.0 {
+		t.Errorf("base should be kept when overlay is missing: %v", c.ToFlatMap())
+	}
+}
+
+func TestOptionalFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewConfig()
+	err = c.AddSource(NewOptionalFileSource(filepath.Join(dir, "missing.yaml")))
+	if err != nil {
+		t.Errorf("missing optional file should not fail: %s", err)
+	}
+	broken := filepath.Join(dir, "broken.json")
+	ioutil.WriteFile(broken, []byte("{"), 0644)
+	err = c.AddSource(NewOptionalFileSource(broken))
+	if err == nil {
+		t.Errorf("broken optional file should fail")
+	}
+	including := filepath.Join(dir, "including.yaml")
+	ioutil.WriteFile(including, []byte("a: !include missing.yaml"), 0644)
+	err = c.AddSource(NewOptionalFileSource(including, WithIncludes()))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing included file should fail, got: %v", err)
+	}
+	if os.Geteuid() != 0 {
+		denied := filepath.Join(dir, "denied.yaml")
+		ioutil.WriteFile(denied, []byte("a: 1"), 0)
+		err = c.AddSource(NewOptionalFileSource(denied))
+		if err == nil {
+			t.Errorf("unreadable optional file should fail")
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"b": {"c": 2}, "a": 1}`), "json"))
+	var keys []string
+	c.Walk(func(key string, value interface{}) {
+		keys = append(keys, key)
+	})
+	if fmt.Sprint(keys) != "[a b.c]" {
+		t.Errorf("unexpected walk order: %v", keys)
+	}
+	var paths [][]string
+	c.WalkHierarchical(func(path []string, value interface{}) {
+		paths = append(paths, path)
+	})
+	if fmt.Sprint(paths) != "[[a] [b c]]" {
+		t.Errorf("unexpected walk paths: %v", paths)
+	}
+}
+
+func TestStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unable to create pipe: %s", err)
+	}
+	stdin := os.Stdin
+	defer func() { os.Stdin = stdin }()
+	os.Stdin = r
+	w.Write([]byte("a: 1"))
+	w.Close()
+	c := NewConfig()
+	err = c.AddSource(NewStdinSource("yaml"))
+	if err != nil {
+		t.Fatalf("unable to add stdin source: %s", err)
+	}
+	if c.ToFlatMap()["a"] != 1.0 {
+		t.Errorf("unexpected stdin values: %v", c.ToFlatMap())
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	c := NewConfig()
+	c.SetDefault("server.port", 8080)
+	c.SetDefault("server.host", "localhost")
+	c.AddSource(NewBufSource([]byte(`{"server": {"host": "example.com"}}`), "json"))
+	v := struct {
+		Server struct {
+			Host string
+			Port int
+		}
+	}{}
+	err := c.Unmarshal("", &v)
+	if err != nil {
+		t.Fatalf("unable to unmarshal: %s", err)
+	}
+	if v.Server.Host != "example.com" || v.Server.Port != 8080 {
+		t.Errorf("unexpected values: %#v", v)
+	}
+}
+
+func TestConstraints(t *testing.T) {
+	type server struct {
+		Port int    `gonfic:"min=1,max=65535"`
+		Env  string `gonfic:"oneof=dev staging prod"`
+	}
+	v := struct {
+		Servers map[string]*server
+	}{}
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"servers": {"a": {"port": 80, "env": "prod"}}}`), "json"))
+	err := c.Unmarshal("", &v, WithConstraints())
+	if err != nil {
+		t.Errorf("valid config should pass constraints: %s", err)
+	}
+	c.AddSource(NewBufSource([]byte(`{"servers": {"b": {"port": 70000, "env": "test"}}}`), "json"))
+	err = c.Unmarshal("", &v, WithConstraints())
+	if err == nil {
+		t.Fatalf("invalid config should fail constraints")
+	}
+	if !strings.Contains(err.Error(), "servers.b.port: 70000 is greater than max 65535") ||
+		!strings.Contains(err.Error(), `servers.b.env: "test" is not one of dev, staging, prod`) {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err = c.Unmarshal("", &v)
+	if err != nil {
+		t.Errorf("constraints should be opt-in: %s", err)
+	}
+}
+
+func TestString(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"db": {"password": "secret"}, "name": "app"}`), "json"))
+	s := fmt.Sprint(c)
+	if strings.Contains(s, "secret") || s != "gonfic.Config{keys: 2, sources: 1}" {
+		t.Errorf("unexpected string: %s", s)
+	}
+	if d := c.DumpVerbose(); d != "db.password=secret\nname=app\n" {
+		t.Errorf("unexpected dump: %q", d)
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "main.yaml"), []byte("common: !include common.yaml\ndb:\n  $include: db.json\n  host: override"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "common.yaml"), []byte("a: 1"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "db.json"), []byte(`{"host": "localhost", "port": 5432}`), 0644)
+	c := NewConfig()
+	err = c.AddSource(NewFileSource(filepath.Join(dir, "main.yaml"), WithIncludes()))
+	if err != nil {
+		t.Fatalf("unable to add file source: %s", err)
+	}
+	fm := c.ToFlatMap()
+	if fm["common.a"] != 1.0 || fm["db.host"] != "override" || fm["db.port"] != 5432.0 {
+		t.Errorf("unexpected included values: %v", fm)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "text.yaml"), []byte("# add !include foo to include foo\na: \"use !include foo\"\nb: 'or !include bar'\nc: !include 'common.yaml'"), 0644)
+	c = NewConfig()
+	err = c.AddSource(NewFileSource(filepath.Join(dir, "text.yaml"), WithIncludes()))
+	if err != nil {
+		t.Fatalf("!include in strings and comments should be left as is: %s", err)
+	}
+	if fmt.Sprint(c.ToFlatMap()) != "map[a:use !include foo b:or !include bar c.a:1]" {
+		t.Errorf("unexpected values: %v", c.ToFlatMap())
+	}
+	ioutil.WriteFile(filepath.Join(dir, "a.yaml"), []byte("b: !include b.yaml"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "b.yaml"), []byte("a: !include a.yaml"), 0644)
+	err = NewConfig().AddSource(NewFileSource(filepath.Join(dir, "a.yaml"), WithIncludes()))
+	if err == nil || !strings.Contains(err.Error(), "include cycle") {
+		t.Errorf("include cycle should fail, got: %v", err)
+	}
+}
+
+func TestGetStringMap(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`plugins:
+  foo:
+    enabled: true
+    retries: 3
+    hosts: [a, b]
+    tls:
+      cert: c.pem
+  bar:
+    enabled: false`), "yaml"))
+	m := c.GetStringMapString("plugins.foo")
+	if len(m) != 4 || m["enabled"] != "1" || m["retries"] != "3" || m["tls.cert"] != "c.pem" {
+		t.Errorf("unexpected string map: %v", m)
+	}
+	ms := c.GetStringMapStringSlice("plugins.foo")
+	if fmt.Sprint(ms["hosts"]) != "[a b]" || fmt.Sprint(ms["retries"]) != "[3]" {
+		t.Errorf("unexpected string slice map: %v", ms)
+	}
+	if fmt.Sprint(c.GetStringMap("plugins.foo")["tls"]) != "map[cert:c.pem]" {
+		t.Errorf("unexpected map: %v", c.GetStringMap("plugins.foo"))
+	}
+	v := struct{ Enabled bool }{}
+	c.Unmarshal("plugins.foo", &v)
+	if !v.Enabled {
+		t.Errorf("unmarshal should decode the prefixed keys")
+	}
+}
+
+func TestGetStringMapStringSlice(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"routes": {"/api": ["GET", "POST"], "/health": "GET", "/debug": ["GET", {"x": 1}]}}`), "json"))
+	routes := c.GetStringMapStringSlice("routes")
+	if len(routes) != 3 || fmt.Sprint(routes["/api"]) != "[GET POST]" || fmt.Sprint(routes["/health"]) != "[GET]" {
+		t.Errorf("unexpected routes: %v", routes)
+	}
+	if fmt.Sprint(routes["/debug"]) != "[GET map[x:1]]" {
+		t.Errorf("unconvertible elements should be formatted one by one: %v", routes["/debug"])
+	}
+}
+
+func TestRegisterUnmarshalFunc(t *testing.T) {
+	RegisterUnmarshalFunc("custom", func(buf []byte, v interface{}) error {
+		m := v.(*map[string]interface{})
+		(*m)["a"] = map[interface{}]interface{}{"b": string(buf)}
+		return nil
+	})
+	c := NewConfig()
+	err := c.AddSource(NewBufSource([]byte("hello"), "custom"))
+	if err != nil {
+		t.Fatalf("unable to add custom source: %s", err)
+	}
+	if c.ToFlatMap()["a.b"] != "hello" {
+		t.Errorf("unexpected custom values: %v", c.ToFlatMap())
+	}
+}
+
+func TestBytes(t *testing.T) {
+	in := NewConfig()
+	in.AddSource(NewBufSource([]byte(`{"a": {"b": "c", "d": [1, 2]}}`), "json"))
+	for _, format := range []string{"json", "yaml", "cbor"} {
+		buf, err := in.Bytes(format)
+		if err != nil {
+			t.Errorf("unable to write %s: %s", format, err)
+			continue
+		}
+		out := NewConfig()
+		err = out.AddSource(NewBufSource(buf, format))
+		if err != nil {
+			t.Errorf("unable to read back %s: %s", format, err)
+			continue
+		}
+		if fmt.Sprint(out.ToHierarchicalMap()) != fmt.Sprint(in.ToHierarchicalMap()) {
+			t.Errorf("%s round-trip mismatch: %v", format, out.ToHierarchicalMap())
+		}
+	}
+	if _, err := in.Bytes("nope"); err == nil {
+		t.Errorf("unknown format should fail")
+	}
+}
+
+func TestLocation(t *testing.T) {
+	loc := time.FixedZone("EST", -5*3600)
+	c := NewConfig(WithLocation(loc))
+	c.AddSource(NewBufSource([]byte(`{"at": "09:00", "on": "2020-01-02 09:00", "utc": "2020-01-02T09:00:00Z"}`), "json"))
+	v := struct {
+		At  time.Time
+		On  time.Time
+		UTC time.Time
+	}{}
+	err := c.Unmarshal("", &v)
+	if err != nil {
+		t.Fatalf("unable to unmarshal: %s", err)
+	}
+	if v.At.Location() != loc || v.At.Hour() != 9 {
+		t.Errorf("unexpected at: %s", v.At)
+	}
+	if !v.On.Equal(time.Date(2020, 1, 2, 14, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected on: %s", v.On)
+	}
+	if !v.UTC.Equal(time.Date(2020, 1, 2, 9, 0, 0, 0, time.UTC)) {
+		t.Errorf("explicit offset should be kept: %s", v.UTC)
+	}
+}
+
+func TestTagDefaults(t *testing.T) {
+	type db struct {
+		Host string `json:"host" default:"localhost"`
+		Port int    `json:"port" default:"5432"`
+	}
+	type config struct {
+		Name     string        `json:"name" default:"app"`
+		Timeout  time.Duration `json:"timeout" default:"5s"`
+		Database *db           `json:"database"`
+	}
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"database": {"host": "db.example.com"}}`), "json"))
+	c.AddSource(NewTagDefaultsSource(&config{}))
+	v := config{}
+	err := c.Unmarshal("", &v)
+	if err != nil {
+		t.Fatalf("unable to unmarshal: %s", err)
+	}
+	if v.Name != "app" || v.Timeout != 5*time.Second || v.Database == nil ||
+		v.Database.Host != "db.example.com" || v.Database.Port != 5432 {
+		t.Errorf("unexpected values: %#v %#v", v, v.Database)
+	}
+}
+
+func TestUnsupportedExtension(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yam")
+	ioutil.WriteFile(path, []byte("a: 1"), 0644)
+	err = NewConfig().AddSource(NewFileSource(path))
+	if err == nil {
+		t.Fatalf("unsupported extension should fail")
+	}
+	if !strings.Contains(err.Error(), path) || !strings.Contains(err.Error(), `"yam" is not a supported extension`) ||
+		!strings.Contains(err.Error(), "toml, yaml, yml") || !strings.Contains(err.Error(), `did you mean "yaml"?`) {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestUnmarshalKeyStrict(t *testing.T) {
+	type db struct {
+		Host string
+		Port int
+	}
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"db": {"host": "localhost", "port": 5432}, "other": {"x": "1"}}`), "json"))
+	v := db{}
+	err := c.UnmarshalKeyStrict("db", &v)
+	if err != nil || v.Host != "localhost" || v.Port != 5432 {
+		t.Errorf("unable to strictly unmarshal: %v %#v", err, v)
+	}
+	c.AddSource(NewBufSource([]byte(`{"db": {"hots": "typo"}}`), "json"))
+	err = c.UnmarshalKeyStrict("db", &db{})
+	if err == nil || !strings.Contains(err.Error(), "hots") {
+		t.Errorf("extra key should fail, got: %v", err)
+	}
+	c = NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"db": {"port": "5432"}}`), "json"))
+	err = c.UnmarshalKeyStrict("db", &db{})
+	if err == nil {
+		t.Errorf("string port should fail without weak typing")
+	}
+	if err = c.Unmarshal("db", &db{}); err != nil {
+		t.Errorf("lenient unmarshal should still work: %s", err)
+	}
+}
+
+func TestSourceFunc(t *testing.T) {
+	c := NewConfig()
+	err := c.AddSource(SourceFunc(func(config map[string]interface{}) (map[string]interface{}, error) {
+		config["a"] = "b"
+		return config, nil
+	}))
+	if err != nil || c.ToFlatMap()["a"] != "b" {
+		t.Errorf("unexpected source func result: %v %v", err, c.ToFlatMap())
+	}
+}
+
+func TestEnv(t *testing.T) {
+	os.Setenv("GONFIC_SERVER_MAX__CONNS", "10")
+	defer os.Unsetenv("GONFIC_SERVER_MAX__CONNS")
+	c := NewConfig()
+	c.AddSource(NewEnvSource())
+	if c.ToFlatMap()["gonfic.server.max_conns"] != "10" {
+		t.Errorf("double underscore should be a literal underscore: %v", c.ToFlatMap())
+	}
+	c = NewConfig()
+	c.AddSource(NewEnvSource(WithEnvNestingDelimiter("__")))
+	if c.ToFlatMap()["gonfic_server_max.conns"] != "10" {
+		t.Errorf("double underscore should be the delimiter: %v", c.ToFlatMap())
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"db": {"maxconns": 10, "host": "a"}, "other": 1}`), "json"))
+	var changes []string
+	sub := c.Subscribe("db", func(key string, old, new interface{}) {
+		changes = append(changes, fmt.Sprintf("%s:%v->%v", key, old, new))
+	})
+	c.Rebuild(NewBufSource([]byte(`{"db": {"maxconns": 20, "port": 5432}, "other": 2}`), "json"))
+	if fmt.Sprint(changes) != "[db.host:a-><nil> db.maxconns:10->20 db.port:<nil>->5432]" {
+		t.Errorf("unexpected changes: %v", changes)
+	}
+	sub.Unsubscribe()
+	changes = nil
+	c.AddSource(NewBufSource([]byte(`{"db": {"maxconns": 30}}`), "json"))
+	if len(changes) != 0 {
+		t.Errorf("unsubscribed fn should not be called: %v", changes)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(path, []byte(`{"a": "0123456789"}`), 0644)
+	err = NewConfig().AddSource(NewFileSource(path, WithMaxBytes(10)))
+	if err == nil || !strings.Contains(err.Error(), "config too large") {
+		t.Errorf("file over the limit should fail, got: %v", err)
+	}
+	err = NewConfig().AddSource(NewFileSource(path, WithMaxBytes(100)))
+	if err != nil {
+		t.Errorf("file under the limit should load: %s", err)
+	}
+}
+
+func TestUnmarshalKeyWithDefaults(t *testing.T) {
+	type db struct {
+		Host    string
+		Port    int
+		Options map[string]string
+	}
+	defaults := db{Host: "localhost", Port: 5432, Options: map[string]string{"sslmode": "disable"}}
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"db": {"host": "db.example.com", "options": {"timeout": "5"}}}`), "json"))
+	v := db{}
+	err := c.UnmarshalKeyWithDefaults("db", defaults, &v)
+	if err != nil {
+		t.Fatalf("unable to unmarshal: %s", err)
+	}
+	if v.Host != "db.example.com" || v.Port != 5432 || v.Options["sslmode"] != "disable" || v.Options["timeout"] != "5" {
+		t.Errorf("unexpected values: %#v", v)
+	}
+	if len(defaults.Options) != 1 {
+		t.Errorf("defaults should not be modified: %#v", defaults)
+	}
+}
+
+func TestArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	files := []struct{ name, body string }{
+		{"20-override.yaml", "a: 2"},
+		{"README.txt", "not a config"},
+		{"10-base.json", `{"a": 1, "b": 1}`},
+	}
+	zpath := filepath.Join(dir, "config.zip")
+	zf, _ := os.Create(zpath)
+	zw := zip.NewWriter(zf)
+	tpath := filepath.Join(dir, "config.tar.gz")
+	tf, _ := os.Create(tpath)
+	gw := gzip.NewWriter(tf)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		w, _ := zw.Create(file.name)
+		w.Write([]byte(file.body))
+		tw.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.body)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(file.body))
+	}
+	zw.Close()
+	zf.Close()
+	tw.Close()
+	gw.Close()
+	tf.Close()
+	for _, path := range []string{zpath, tpath} {
+		c := NewConfig()
+		err = c.AddSource(NewArchiveSource(path))
+		if err != nil {
+			t.Errorf("unable to add archive source %s: %s", path, err)
+			continue
+		}
+		if fm := c.ToFlatMap(); len(fm) != 2 || fm["a"] != 2.0 || fm["b"] != 1.0 {
+			t.Errorf("unexpected archive values for %s: %v", path, fm)
+		}
+	}
+}
+
+func TestConflictError(t *testing.T) {
+	c := NewConfig(WithConflictError())
+	c.AddSource(NewBufSource([]byte(`{"a": 1, "b": 1}`), "json"))
+	err := c.AddSource(NewBufSource([]byte(`{"a": 1, "c": 1}`), "json"))
+	if err != nil {
+		t.Errorf("same value should not conflict: %s", err)
+	}
+	err = c.AddSource(NewBufSource([]byte(`{"b": 2}`), "json"))
+	if err == nil || err.Error() != "conflicting values for b (1 then 2)" {
+		t.Errorf("different value should conflict, got: %v", err)
+	}
+	if c.ToFlatMap()["b"] != 1.0 {
+		t.Errorf("conflicting source should not be applied")
+	}
+}
+
+func TestGet(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"Server": {"Port": 8080}}`), "json"))
+	if v, ok := c.Get("Server.Port"); !ok || v != 8080.0 {
+		t.Errorf("unexpected value: %v %v", v, ok)
+	}
+	if _, ok := c.Get("server.host"); ok {
+		t.Errorf("missing key should not be found")
+	}
+}
+
+func TestMergeFlatMap(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"a": {"b": 1, "c": 1}}`), "json"))
+	err := c.MergeFlatMap(map[string]interface{}{"a.b": 2, "d": "x"})
+	if err != nil {
+		t.Fatalf("unable to merge flat map: %s", err)
+	}
+	if fm := c.ToFlatMap(); fm["a.b"] != 2 || fm["a.c"] != 1.0 || fm["d"] != "x" {
+		t.Errorf("unexpected values: %v", fm)
+	}
+	for _, fm := range []map[string]interface{}{{"a..b": 1}, {"": 1}, {"a": map[string]interface{}{"b": 1}}} {
+		if err := c.MergeFlatMap(fm); err == nil {
+			t.Errorf("invalid flat map %v should fail", fm)
+		}
+	}
+}
+
+func TestExpect(t *testing.T) {
+	c := NewConfig()
+	c.ExpectInt("server.port")
+	c.ExpectDuration("server.timeout")
+	err := c.AddSource(NewBufSource([]byte(`{"server": {"port": "8080", "timeout": "5s"}}`), "json"))
+	if err != nil {
+		t.Errorf("coercible values should be accepted: %s", err)
+	}
+	err = c.AddSource(NewBufSource([]byte(`{"server": {"port": "http", "timeout": "soon"}}`), "json"))
+	if err == nil || !strings.Contains(err.Error(), "server.port: expected int") || !strings.Contains(err.Error(), "server.timeout: expected time.Duration") {
+		t.Errorf("wrong types should fail, got: %v", err)
+	}
+	c.SetDefault("debug", "maybe")
+	c.ExpectBool("debug")
+	if err := c.ValidateTypes(); err == nil {
+		t.Errorf("wrong default type should fail validation")
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"url": "https://{{.host}}:{{.port}}/api", "port": 8080}`), "json"))
+	c.SetDefault("name", "{{.host}}")
+	err := c.ExpandTemplate(map[string]interface{}{"host": "example.com", "port": 443})
+	if err != nil {
+		t.Fatalf("unable to expand: %s", err)
+	}
+	if fm := c.ToFlatMap(); fm["url"] != "https://example.com:443/api" || fm["port"] != 8080.0 || fm["name"] != "example.com" {
+		t.Errorf("unexpected values: %v", fm)
+	}
+	c.AddSource(NewBufSource([]byte(`{"bad": "{{.missing}}"}`), "json"))
+	if err := c.ExpandTemplate(map[string]interface{}{}); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("missing key should fail, got: %v", err)
+	}
+	c = NewConfig()
+	c.AddNamedSource("app", NewBufSource([]byte(`{"url": "https://{{.host}}/v1"}`), "json"))
+	if err := c.ExpandTemplate(map[string]interface{}{"host": "example.com"}); err != nil {
+		t.Fatalf("unable to expand: %s", err)
+	}
+	if origin, _ := c.Origin("url"); origin != "template" {
+		t.Errorf("expanded value should come from template, got: %s", origin)
+	}
+	if err := c.ReplaceSource("app", NewBufSource([]byte(`{"url": "https://{{.host}}/v2"}`), "json")); err != nil {
+		t.Fatalf("unable to replace source: %s", err)
+	}
+	if url := c.ToFlatMap()["url"]; url != "https://example.com/v2" {
+		t.Errorf("replaced source should be expanded again: %v", url)
+	}
+}
+
+func TestExplain(t *testing.T) {
+	os.Setenv("GONFIC_EXPLAIN", "env")
+	defer os.Unsetenv("GONFIC_EXPLAIN")
+	c := NewConfig()
+	c.SetDefault("name", "app")
+	c.AddSource(NewBufSource([]byte(`{"gonfic": {"explain": "json"}, "port": 1}`), "json"))
+	c.AddSource(NewEnvSource())
+	c.MergeFlatMap(map[string]interface{}{"port": 2})
+	got := map[string]Explanation{}
+	for _, e := range c.Explain() {
+		got[e.Key] = e
+	}
+	if e := got["gonfic.explain"]; fmt.Sprint(e.Sources) != "[buf:json env]" || e.Winner != "env" {
+		t.Errorf("unexpected explanation: %#v", e)
+	}
+	if e := got["port"]; fmt.Sprint(e.Sources) != "[buf:json flat map]" || e.Winner != "flat map" {
+		t.Errorf("unexpected explanation: %#v", e)
+	}
+	if e := got["name"]; e.Winner != "default" {
+		t.Errorf("unexpected explanation: %#v", e)
+	}
+}
+
+func TestGetDurationSlice(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"backoff": ["1s", "2s", "4s"], "csv": "1m, 1h", "bad": ["1s", "soon"]}`), "json"))
+	ds, err := c.GetDurationSlice("backoff")
+	if err != nil || fmt.Sprint(ds) != "[1s 2s 4s]" {
+		t.Errorf("unexpected durations: %v %v", ds, err)
+	}
+	ds, err = c.GetDurationSlice("csv")
+	if err != nil || fmt.Sprint(ds) != "[1m0s 1h0m0s]" {
+		t.Errorf("unexpected durations: %v %v", ds, err)
+	}
+	_, err = c.GetDurationSlice("bad")
+	if err == nil || !strings.HasPrefix(err.Error(), "bad[1]:") {
+		t.Errorf("bad element should be reported, got: %v", err)
+	}
+}
+
+func TestYAMLAnchors(t *testing.T) {
+	buf := `defaults: &defaults
+  adapter: postgres
+  host: localhost
+hosts: &hosts [a, b]
+development:
+  <<: *defaults
+  database: dev
+test:
+  <<: *defaults
+  host: test.example.com
+  replicas: *hosts`
+	c := NewConfig()
+	err := c.AddSource(NewBufSource([]byte(buf), "yaml"))
+	if err != nil {
+		t.Fatalf("unable to add yaml source: %s", err)
+	}
+	fm := c.ToFlatMap()
+	if fm["development.adapter"] != "postgres" || fm["development.host"] != "localhost" || fm["development.database"] != "dev" {
+		t.Errorf("merge key not expanded: %v", fm)
+	}
+	if fm["test.adapter"] != "postgres" || fm["test.host"] != "test.example.com" || fmt.Sprint(fm["test.replicas"]) != "[a b]" {
+		t.Errorf("alias not expanded: %v", fm)
+	}
+}
+
+func TestToProperties(t *testing.T) {
+	c := NewConfig()
+	err := c.AddSource(NewBufSource([]byte(`{"a":{"b":"x=1: é","n":8080},"c":[1,2],"d":" lead\nline","e:f":true}`), "json"))
+	if err != nil {
+		t.Fatalf("unable to add json source: %s", err)
+	}
+	buf, err := c.ToProperties()
+	if err != nil {
+		t.Fatalf("unable to write properties: %s", err)
+	}
+	expected := "a.b=x=1: \\u00e9\na.n=8080\nc=[1,2]\nd=\\ lead\\nline\ne\\:f=true\n"
+	if string(buf) != expected {
+		t.Errorf("expected %q, got %q", expected, buf)
+	}
+	viaBytes, err := c.Bytes("properties")
+	if err != nil || string(viaBytes) != expected {
+		t.Errorf("expected %q from Bytes, got %q (%v)", expected, viaBytes, err)
+	}
+}
+
+func TestToEnv(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"server": {"max_conns": 10, "hosts": ["a", "b"]}}`), "json"))
+	env := c.ToEnv("gonfictoenv")
+	if fmt.Sprint(env) != `[GONFICTOENV_SERVER_HOSTS=["a","b"] GONFICTOENV_SERVER_MAX__CONNS=10]` {
+		t.Errorf("unexpected env: %v", env)
+	}
+	for _, pair := range env {
+		kv := strings.SplitN(pair, "=", 2)
+		os.Setenv(kv[0], kv[1])
+		defer os.Unsetenv(kv[0])
+	}
+	back := NewConfig()
+	back.AddSource(NewEnvSource())
+	if back.ToFlatMap()["gonfictoenv.server.max_conns"] != "10" {
+		t.Errorf("env should round trip through NewEnvSource: %v", back.ToFlatMap())
+	}
+	var server struct {
+		MaxConns int `mapstructure:"max_conns"`
+		Hosts    []string
+	}
+	if err := back.Unmarshal("gonfictoenv.server", &server); err != nil || server.MaxConns != 10 || fmt.Sprintf("%q", server.Hosts) != `["a" "b"]` {
+		t.Errorf("env should unmarshal back: %+v, %v", server, err)
+	}
+	if hosts := back.GetStringSliceOr("gonfictoenv.server.hosts", nil); fmt.Sprintf("%q", hosts) != `["a" "b"]` {
+		t.Errorf("env list should be got back: %q", hosts)
+	}
+}
+
+func TestNull(t *testing.T) {
+	for _, src := range []Source{
+		NewBufSource([]byte("a: null\nb: 1\nc:\n  d: null"), "yaml"),
+		NewBufSource([]byte(`{"a": null, "b": 1, "c": {"d": null}}`), "json"),
+	} {
+		c := NewConfig()
+		c.SetDefault("a", "default")
+		if err := c.AddSource(src); err != nil {
+			t.Fatalf("unable to add source: %s", err)
+		}
+		for _, key := range []string{"a", "c.d"} {
+			if value, ok := c.Get(key); !ok || value != nil {
+				t.Errorf("%s should be set to nil, got %v (%v)", key, value, ok)
+			}
+		}
+		if _, ok := c.Get("missing"); ok {
+			t.Errorf("missing key should not be set")
+		}
+		if s := c.GetStringMapString("c"); len(s) != 1 || s["d"] != "" {
+			t.Errorf("nil should be an empty string: %v", s)
+		}
+	}
+	c := NewConfig()
+	c.MergeFlatMap(map[string]interface{}{"a": nil, "a.b": 1})
+	if fmt.Sprint(c.ToHierarchicalMap()) != "map[a:map[b:1]]" {
+		t.Errorf("nested key should replace nil leaf: %v", c.ToHierarchicalMap())
+	}
+}
+
+func TestCommand(t *testing.T) {
+	c := NewConfig()
+	err := c.AddSource(NewCommandSource("sh", []string{"-c", `echo '{"secret": {"password": "s3cr3t"}}'`}, "json"))
+	if err != nil {
+		t.Fatalf("unable to add command source: %s", err)
+	}
+	if c.ToFlatMap()["secret.password"] != "s3cr3t" {
+		t.Errorf("command output not loaded: %v", c.ToFlatMap())
+	}
+	err = c.AddSource(NewCommandSource("sh", []string{"-c", "echo denied >&2; exit 3"}, "json"))
+	if err == nil || !strings.Contains(err.Error(), "exit status 3") || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("failing command should report its status and stderr, got: %v", err)
+	}
+	err = c.AddSource(NewCommandSource("sleep", []string{"5"}, "json", WithTimeout(50*time.Millisecond)))
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Errorf("slow command should time out, got: %v", err)
+	}
+}
+
+func TestLen(t *testing.T) {
+	c := NewConfig()
+	if c.Len() != 0 || !c.IsEmpty() {
+		t.Errorf("new config should be empty: %d", c.Len())
+	}
+	c.SetDefault("a", 1)
+	c.AddSource(NewBufSource([]byte(`{"a": 2, "b": {"c": 3, "d": 4}}`), "json"))
+	if c.Len() != 3 || c.IsEmpty() {
+		t.Errorf("expected 3 keys, got %d", c.Len())
+	}
+}
+
+func TestObserver(t *testing.T) {
+	var events []SourceEvent
+	c := NewConfig(WithObserver(func(e SourceEvent) {
+		events = append(events, e)
+	}))
+	c.AddSource(NewBufSource([]byte(`{"a": 1, "b": 2}`), "json"))
+	c.AddSource(NewBufSource([]byte(`{"b": 3, "c": 4, "a": 1}`), "yaml"))
+	c.AddSource(NewBufSource([]byte(`{`), "json"))
+	if len(events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(events))
+	}
+	if events[0].Source != "buf:json" || fmt.Sprint(events[0].Added) != "[a b]" || len(events[0].Overridden) != 0 {
+		t.Errorf("unexpected first event: %+v", events[0])
+	}
+	if fmt.Sprint(events[1].Added) != "[c]" || fmt.Sprint(events[1].Overridden) != "[b]" {
+		t.Errorf("unexpected second event: %+v", events[1])
+	}
+	if events[2].Err == nil {
+		t.Errorf("failing source should be reported: %+v", events[2])
+	}
+}
+
+func TestMarshalJSON(t *testing.T) {
+	var doc struct {
+		Name   string
+		Config Config
+		Ptr    *Config
+	}
+	err := json.Unmarshal([]byte(`{"Name": "app", "Config": {"db": {"port": 5432}}, "Ptr": {"a": "b"}}`), &doc)
+	if err != nil {
+		t.Fatalf("unable to unmarshal json: %s", err)
+	}
+	if doc.Config.ToFlatMap()["db.port"] != 5432.0 || doc.Ptr.ToFlatMap()["a"] != "b" {
+		t.Errorf("embedded configs not loaded: %v %v", doc.Config.ToFlatMap(), doc.Ptr.ToFlatMap())
+	}
+	doc.Config.SetDefault("db.host", "localhost")
+	buf, err := json.Marshal(&doc)
+	if err != nil {
+		t.Fatalf("unable to marshal json: %s", err)
+	}
+	expected := `{"Name":"app","Config":{"db":{"host":"localhost","port":5432}},"Ptr":{"a":"b"}}`
+	if string(buf) != expected {
+		t.Errorf("expected %s, got %s", expected, buf)
+	}
+}
+
+func TestScalarToSlice(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte("hosts: a.com\nports: 80\nraw: abc"), "yaml"))
+	var s struct {
+		Hosts []string
+		Ports []int
+		Raw   []byte
+	}
+	if err := c.Unmarshal("", &s); err != nil {
+		t.Fatalf("unable to unmarshal: %s", err)
+	}
+	if fmt.Sprint(s.Hosts) != "[a.com]" || fmt.Sprint(s.Ports) != "[80]" || string(s.Raw) != "abc" {
+		t.Errorf("scalars should be wrapped into slices: %+v", s)
+	}
+	c.AddSource(NewBufSource([]byte("web:\n  hosts: b.com"), "yaml"))
+	var web struct {
+		Hosts []string
+	}
+	if err := c.UnmarshalKeyStrict("web", &web); err != nil || fmt.Sprint(web.Hosts) != "[b.com]" {
+		t.Errorf("scalar should be wrapped even with strict types: %v (%v)", web.Hosts, err)
+	}
+}
+
+func TestReplaceSource(t *testing.T) {
+	loads := 0
+	stable := SourceFunc(func(config map[string]interface{}) (map[string]interface{}, error) {
+		loads++
+		config["a"] = "stable"
+		config["b"] = "stable"
+		return config, nil
+	})
+	c := NewConfig()
+	c.AddSource(stable)
+	c.AddNamedSource("remote", NewBufSource([]byte(`{"b": "remote", "c": "remote"}`), "json"))
+	c.AddSource(NewBufSource([]byte(`{"c": "local"}`), "json"))
+	if err := c.AddNamedSource("remote", NewBufSource([]byte(`{}`), "json")); err == nil {
+		t.Errorf("duplicate name should fail")
+	}
+	err := c.ReplaceSource("remote", NewBufSource([]byte(`{"d": "remote"}`), "json"))
+	if err != nil {
+		t.Fatalf("unable to replace source: %s", err)
+	}
+	if fmt.Sprint(c.ToFlatMap()) != "map[a:stable b:stable c:local d:remote]" {
+		t.Errorf("unexpected config after replace: %v", c.ToFlatMap())
+	}
+	if loads != 1 {
+		t.Errorf("sources before the replaced one should not be loaded again: %d loads", loads)
+	}
+	if err := c.ReplaceSource("missing", stable); err == nil {
+		t.Errorf("unknown name should fail")
+	}
+	if err := c.ReplaceSource("remote", NewBufSource([]byte(`{`), "json")); err == nil || c.ToFlatMap()["d"] != "remote" {
+		t.Errorf("failing source should leave the config untouched: %v", err)
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewConfig()
+	err = c.AddSource(NewFileSource(filepath.Join(dir, "missing.yaml")))
+	if !errors.Is(err, ErrNotFound) || !errors.Is(err, os.ErrNotExist) || errors.Is(err, ErrParse) {
+		t.Errorf("missing file should be ErrNotFound, got: %v", err)
+	}
+	err = c.AddSource(NewBufSource([]byte("{"), "json"))
+	var e *Error
+	if !errors.Is(err, ErrParse) || !errors.As(err, &e) || e.Kind != ErrParse {
+		t.Errorf("broken buf should be ErrParse, got: %v", err)
+	}
+	err = c.AddSource(NewBufSource([]byte("a=1"), "nope"))
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("unknown extension should be ErrUnsupportedFormat, got: %v", err)
+	}
+	_, err = c.Bytes("nope")
+	if !errors.Is(err, ErrUnsupportedFormat) {
+		t.Errorf("unknown output format should be ErrUnsupportedFormat, got: %v", err)
+	}
+}
+
+func TestGetOr(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"origins": ["a", "b"], "single": "c", "cleared": null, "bad": {"x": 1}, "headers": {"x": "1"}, "objs": [{"x": 1}]}`), "json"))
+	def := []string{"*"}
+	for key, expected := range map[string]string{"origins": "[a b]", "single": "[c]", "cleared": "[]", "missing": "[*]", "bad.x": "[1]", "objs": "[*]"} {
+		if got := fmt.Sprint(c.GetStringSliceOr(key, def)); got != expected {
+			t.Errorf("%s: expected %s, got %s", key, expected, got)
+		}
+	}
+	if got := c.GetStringSliceOr("bad", def); fmt.Sprint(got) != "[*]" {
+		t.Errorf("unset key should give the default: %v", got)
+	}
+	if got := c.GetStringMapStringOr("headers", nil); fmt.Sprint(got) != "map[x:1]" {
+		t.Errorf("unexpected headers: %v", got)
+	}
+	if got := c.GetStringMapStringOr("missing", map[string]string{"y": "2"}); fmt.Sprint(got) != "map[y:2]" {
+		t.Errorf("missing prefix should give the default: %v", got)
+	}
+	if got := c.GetStringMapOr("missing", map[string]interface{}{"z": 3}); fmt.Sprint(got) != "map[z:3]" {
+		t.Errorf("missing prefix should give the default: %v", got)
+	}
+}
+
+func TestGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %s: %s", args, err, out)
+		}
+	}
+	git("init", "--quiet")
+	os.MkdirAll(filepath.Join(dir, "config"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "config", "app.yaml"), []byte("a: 1"), 0644)
+	git("add", ".")
+	git("commit", "--quiet", "-m", "v1")
+	git("tag", "v1")
+	ioutil.WriteFile(filepath.Join(dir, "config", "app.yaml"), []byte("a: 2"), 0644)
+	git("commit", "--quiet", "-am", "v2")
+	url := "file://" + filepath.ToSlash(dir)
+	c := NewConfig()
+	if err := c.AddSource(NewGitSource(url, "v1", "config/app.yaml")); err != nil {
+		t.Fatalf("unable to add git source: %s", err)
+	}
+	if c.ToFlatMap()["a"] != 1.0 {
+		t.Errorf("file at tag v1 not loaded: %v", c.ToFlatMap())
+	}
+	err = c.AddSource(NewGitSource(url, "v1", "config/missing.yaml"))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing file should be ErrNotFound, got: %v", err)
+	}
+	err = c.AddSource(NewGitSource(url, "nope", "config/app.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "nope") {
+		t.Errorf("missing ref should fail, got: %v", err)
+	}
+	pwned := filepath.Join(dir, "pwned")
+	err = c.AddSource(NewGitSource("--upload-pack=touch "+pwned+";", "v1", "config/app.yaml"))
+	if err == nil || !strings.Contains(err.Error(), "cannot start with -") {
+		t.Errorf("url starting with - should fail, got: %v", err)
+	}
+	if _, err := os.Stat(pwned); err == nil {
+		t.Errorf("url starting with - should not be run as an option")
+	}
+	if err := c.AddSource(NewGitSource(url, "--upload-pack=touch "+pwned, "config/app.yaml")); err == nil {
+		t.Errorf("ref starting with - should fail")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not installed")
+	}
+	out, err := exec.Command("sh", "-c", "printf %s "+shellQuote("/keys/it's $HOME `id` \\n")).Output()
+	if err != nil {
+		t.Fatalf("unable to run sh: %s", err)
+	}
+	if string(out) != "/keys/it's $HOME `id` \\n" {
+		t.Errorf("unexpected quoted value: %s", out)
+	}
+}
+
+func TestLoadAtomic(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"a": 1}`), "json"))
+	var changes []string
+	c.Subscribe("", func(key string, old, new interface{}) {
+		changes = append(changes, key)
+	})
+	err := c.LoadAtomic(NewBufSource([]byte(`{"a": 2, "b": 2}`), "json"), NewBufSource([]byte(`{`), "json"))
+	if err == nil {
+		t.Fatalf("failing source should fail")
+	}
+	if fmt.Sprint(c.ToFlatMap()) != "map[a:1]" || len(changes) != 0 {
+		t.Errorf("config should be untouched: %v %v", c.ToFlatMap(), changes)
+	}
+	err = c.LoadAtomic(NewBufSource([]byte(`{"a": 2, "b": 2}`), "json"), NewBufSource([]byte(`{"c": 3}`), "json"))
+	if err != nil {
+		t.Fatalf("unable to load sources: %s", err)
+	}
+	if fmt.Sprint(c.ToFlatMap()) != "map[a:2 b:2 c:3]" || fmt.Sprint(changes) != "[a b c]" {
+		t.Errorf("sources not loaded: %v %v", c.ToFlatMap(), changes)
+	}
+	if c.String() != "gonfic.Config{keys: 3, sources: 3}" {
+		t.Errorf("sources not recorded: %s", c)
+	}
+}
+
+func TestYAMLDocument(t *testing.T) {
+	buf := `# server settings
+server:
+  host: localhost # the host
+  # the port
+  port: 8080
+name: app
+`
+	d, err := NewYAMLDocument([]byte(buf))
+	if err != nil {
+		t.Fatalf("unable to parse yaml document: %s", err)
+	}
+	if err := d.Set("server.port", 9090); err != nil {
+		t.Fatalf("unable to set existing key: %s", err)
+	}
+	if err := d.Set("server.tls.cert", "c.pem"); err != nil {
+		t.Fatalf("unable to set new key: %s", err)
+	}
+	if err := d.Set("name.first", "x"); err == nil {
+		t.Errorf("setting under a scalar should fail")
+	}
+	out, err := d.ToYAML()
+	if err != nil {
+		t.Fatalf("unable to write yaml document: %s", err)
+	}
+	expected := `# server settings
+server:
+  host: localhost # the host
+  # the port
+  port: 9090
+  tls:
+    cert: c.pem
+name: app
+`
+	if string(out) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, out)
+	}
+	c := NewConfig()
+	if err := c.AddSource(d); err != nil {
+		t.Fatalf("unable to add yaml document: %s", err)
+	}
+	var s struct {
+		Server struct {
+			Port int
+			TLS  struct{ Cert string }
+		}
+	}
+	c.Unmarshal("", &s)
+	if s.Server.Port != 9090 || s.Server.TLS.Cert != "c.pem" {
+		t.Errorf("yaml document not loaded: %+v", s)
+	}
+}
+
+func TestOverlay(t *testing.T) {
+	c := NewConfig()
+	c.SetDefault("timeout", "1s")
+	c.AddSource(NewBufSource([]byte(`{"a": 1, "b": 1}`), "json"))
+	o, err := c.Overlay(NewBufSource([]byte(`{"b": 2}`), "json"))
+	if err != nil {
+		t.Fatalf("unable to overlay: %s", err)
+	}
+	if fmt.Sprint(o.ToFlatMap()) != "map[a:1 b:2 timeout:1s]" {
+		t.Errorf("unexpected overlay: %v", o.ToFlatMap())
+	}
+	if fmt.Sprint(c.ToFlatMap()) != "map[a:1 b:1 timeout:1s]" {
+		t.Errorf("config should be unchanged: %v", c.ToFlatMap())
+	}
+	o.SetDefault("timeout", "2s")
+	if c.ToFlatMap()["timeout"] != "1s" {
+		t.Errorf("overlay defaults should not be shared")
+	}
+	if _, err := c.Overlay(NewBufSource([]byte(`{`), "json")); err == nil {
+		t.Errorf("failing source should fail")
+	}
+}
+
+func TestDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, ".env"), []byte(`# from ops
+export DB_HOST=ops.example.com
+DB_NAME='prod' # comment
+DB_USER="a \"b\"" # quoted
+`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "10-defaults.yaml"), []byte("db:\n  host: localhost\n  port: 5432\n  name: dev"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "20-local.json"), []byte(`{"db": {"port": 5433}}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "README.md"), []byte("not config"), 0644)
+	c := NewConfig()
+	if err := c.AddSource(NewDirSource(dir)); err != nil {
+		t.Fatalf("unable to add dir source: %s", err)
+	}
+	if fmt.Sprint(c.ToFlatMap()) != `map[db.host:localhost db.name:dev db.port:5433 db.user:a "b"]` {
+		t.Errorf("files should be loaded by name: %v", c.ToFlatMap())
+	}
+	c = NewConfig()
+	if err := c.AddSource(NewDirSource(dir, WithFormatPrecedence("yaml", "json", "env"))); err != nil {
+		t.Fatalf("unable to add dir source: %s", err)
+	}
+	if fmt.Sprint(c.ToFlatMap()) != `map[db.host:ops.example.com db.name:prod db.port:5433 db.user:a "b"]` {
+		t.Errorf("files should be loaded by format: %v", c.ToFlatMap())
+	}
+	os.MkdirAll(filepath.Join(dir, "15-feature"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "15-feature", "db.yaml"), []byte("db:\n  name: feature\n  port: 1"), 0644)
+	c = NewConfig()
+	if err := c.AddSource(NewDirSource(dir)); err != nil || c.ToFlatMap()["db.name"] != "dev" {
+		t.Errorf("subdirectories should be skipped: %v (%v)", c.ToFlatMap(), err)
+	}
+	c = NewConfig()
+	if err := c.AddSource(NewDirSource(dir, WithRecursive())); err != nil {
+		t.Fatalf("unable to add recursive dir source: %s", err)
+	}
+	if c.ToFlatMap()["db.name"] != "feature" || c.ToFlatMap()["db.port"] != 5433.0 {
+		t.Errorf("subdirectories should be loaded in path order: %v", c.ToFlatMap())
+	}
+	err = c.AddSource(NewDirSource(filepath.Join(dir, "missing")))
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing dir should be ErrNotFound, got: %v", err)
+	}
+	c = NewConfig()
+	c.AddSource(NewBufSource([]byte("SERVER=x\nSERVER_PORT=1"), "env"))
+	if fmt.Sprint(c.ToFlatMap()) != "map[server:x server.port:1]" {
+		t.Errorf("a variable prefix of another should be kept: %v", c.ToFlatMap())
+	}
+}
+
+func TestHierarchicalCache(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"a": {"b": 1}}`), "json"))
+	m := c.ToHierarchicalMap()
+	m["a"].(map[string]interface{})["b"] = 2
+	if fmt.Sprint(c.ToHierarchicalMap()) != "map[a:map[b:1]]" {
+		t.Errorf("returned map should be a copy: %v", c.ToHierarchicalMap())
+	}
+	c.AddSource(NewBufSource([]byte(`{"a": {"c": 3}}`), "json"))
+	c.SetDefault("d", 4)
+	if fmt.Sprint(c.ToHierarchicalMap()) != "map[a:map[b:1 c:3] d:4]" {
+		t.Errorf("cache should be invalidated: %v", c.ToHierarchicalMap())
+	}
+	var v map[string]interface{}
+	c.Unmarshal("a", &v)
+	if fmt.Sprint(v) != "map[b:1 c:3]" {
+		t.Errorf("unexpected prefixed unmarshal: %v", v)
+	}
+}
+
+func TestBranchOnly(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"a": {"b": 1, "c": {"d": 2}}, "e": 3}`), "json"))
+	var v map[string]interface{}
+	if err := c.Unmarshal("a", &v, WithBranchOnly()); err != nil {
+		t.Fatalf("unable to unmarshal: %s", err)
+	}
+	if fmt.Sprint(v) != "map[b:1 c:map[d:2]]" {
+		t.Errorf("unexpected branch: %v", v)
+	}
+	if c.tree != nil {
+		t.Errorf("the whole hierarchical map should not be built")
+	}
+}
+
+// largeConfig returns a config of n keys, in n/100 sections of 100 keys.
+func largeConfig(n int) *Config {
+	fm := make(map[string]interface{}, n)
+	for i := 0; i < n; i++ {
+		fm[fmt.Sprintf("section%d.key%d", i/100, i%100)] = i
+	}
+	c := NewConfig()
+	c.MergeFlatMap(fm)
+	return c
+}
+
+func BenchmarkToHierarchicalMap(b *testing.B) {
+	c := largeConfig(20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.ToHierarchicalMap()
+	}
+}
+
+// BenchmarkUnflatten is the cost of building the hierarchical map on every call, for comparison.
+func BenchmarkUnflatten(b *testing.B) {
+	c := largeConfig(20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		unflatten(c.ToFlatMap(), dotSlicer)
+	}
+}
+
+func BenchmarkUnmarshalPrefix(b *testing.B) {
+	c := largeConfig(20000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var v map[string]int
+		c.Unmarshal("section42", &v)
+	}
+}
+
+// BenchmarkUnmarshalPrefixCold reads a section of a config that just changed,
+// building the whole hierarchical map.
+func BenchmarkUnmarshalPrefixCold(b *testing.B) {
+	c := largeConfig(20000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.invalidateTree()
+		var v map[string]int
+		c.Unmarshal("section42", &v)
+	}
+}
+
+// BenchmarkUnmarshalPrefixBranchOnly is like BenchmarkUnmarshalPrefixCold,
+// building only the section branch.
+func BenchmarkUnmarshalPrefixBranchOnly(b *testing.B) {
+	c := largeConfig(20000)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.invalidateTree()
+		var v map[string]int
+		c.Unmarshal("section42", &v, WithBranchOnly())
+	}
+}
+
+// TestConcurrentReads is meant to be run with -race.
+func TestConcurrentReads(t *testing.T) {
+	c := NewConfig()
+	c.SetDefault("server.timeout", "1s")
+	c.AddSource(NewBufSource([]byte(`{"server": {"port": 8080}}`), "json"))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var s struct{ Port int }
+			c.Unmarshal("server", &s)
+			c.Get("server.port")
+			c.ToHierarchicalMap()
+			c.Bytes("json")
+			if s.Port != 8080 {
+				t.Errorf("unexpected port: %d", s.Port)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	c := NewConfig()
+	c.SetDefault("server.timeout", "1s")
+	notified := make(chan string, 100)
+	c.Subscribe("server", func(key string, old, new interface{}) {
+		// subscribers are notified once unlocked, so they may read
+		c.Get(key)
+		notified <- key
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			c.AddSource(NewBufSource([]byte(fmt.Sprintf(`{"server": {"port%d": %d}}`, i, i)), "json"))
+			c.Set(fmt.Sprintf("server.host%d", i), "localhost")
+		}(i)
+		go func() {
+			defer wg.Done()
+			var s struct{ Timeout time.Duration }
+			c.Unmarshal("server", &s)
+			c.Keys()
+			c.Explain()
+			if fm := c.ToFlatMap(); fm != nil {
+				fm["server.timeout"] = "2s"
+			}
+			if s.Timeout != time.Second {
+				t.Errorf("unexpected timeout: %v", s.Timeout)
+			}
+		}()
+	}
+	wg.Wait()
+	if c.Len() != 17 {
+		t.Errorf("every write should be kept: %v", c.ToFlatMap())
+	}
+	if len(notified) != 16 {
+		t.Errorf("unexpected notifications: %d", len(notified))
+	}
+	if value, _ := c.Get("server.timeout"); value != "1s" {
+		t.Errorf("the flat map should be a copy: %v", value)
+	}
+}
+
+func TestFlags(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("db.host", "localhost", "")
+	fs.Int("db.port", 5432, "")
+	fs.Parse([]string{"-db.port", "5433"})
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"db": {"host": "from-file"}}`), "json"))
+	c.AddSource(NewFlagSource(fs))
+	if fmt.Sprint(c.ToFlatMap()) != "map[db.host:from-file db.port:5433]" {
+		t.Errorf("only set flags should override: %v", c.ToFlatMap())
+	}
+	pfs := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	pfs.SetNormalizeFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		return pflag.NormalizedName(strings.Replace(name, "_", ".", -1))
+	})
+	pfs.String("db_host", "localhost", "")
+	pfs.StringSlice("db.replicas", nil, "")
+	pfs.Bool("debug", false, "")
+	pfs.Parse([]string{"--db_host", "db.example.com", "--db.replicas", "a,b"})
+	c = NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"debug": true}`), "json"))
+	if err := c.BindPFlags(pfs); err != nil {
+		t.Fatalf("unable to bind pflags: %s", err)
+	}
+	if fmt.Sprint(c.ToFlatMap()) != "map[db.host:db.example.com db.replicas:[a b] debug:true]" {
+		t.Errorf("unexpected pflags: %v", c.ToFlatMap())
+	}
+}
+
+type testMetrics struct {
+	reloads, errors, keys int
+	last                  time.Time
+}
+
+func (m *testMetrics) IncReloads()               { m.reloads++ }
+func (m *testMetrics) IncReloadErrors()          { m.errors++ }
+func (m *testMetrics) SetKeys(n int)             { m.keys = n }
+func (m *testMetrics) SetLastReload(t time.Time) { m.last = t }
+
+func TestMetrics(t *testing.T) {
+	m := &testMetrics{}
+	c := NewConfig(WithMetrics(m))
+	c.AddSource(NewBufSource([]byte(`{"a": 1, "b": 2}`), "json"))
+	c.AddSource(NewBufSource([]byte(`{`), "json"))
+	c.Rebuild(NewBufSource([]byte(`{"a": 1, "b": 2, "c": 3}`), "json"))
+	if m.reloads != 3 || m.errors != 1 || m.keys != 3 || m.last.IsZero() {
+		t.Errorf("unexpected metrics: %+v", m)
+	}
+}
+
+type testSpan struct {
+	name  string
+	attrs map[string]interface{}
+	err   error
+	ended bool
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *testSpan) RecordError(err error)                      { s.err = err }
+func (s *testSpan) End()                                       { s.ended = true }
+
+type testTracer struct {
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &testSpan{name: name, attrs: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func TestTracer(t *testing.T) {
+	tracer := &testTracer{}
+	c := NewConfig(WithTracer(tracer))
+	c.AddSource(NewBufSource([]byte(`{"a": 1, "b": 2}`), "json"))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := c.AddSourceContext(ctx, NewCommandSource("sleep", []string{"5"}, "json"))
+	if err == nil {
+		t.Errorf("cancelled context should stop the command")
+	}
+	if len(tracer.spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(tracer.spans))
+	}
+	span := tracer.spans[0]
+	if span.name != "gonfic.buf" || span.attrs["gonfic.keys.added"] != 2 || !span.ended {
+		t.Errorf("unexpected span: %+v", span)
+	}
+	span = tracer.spans[1]
+	if span.name != "gonfic.command" || span.err == nil || !span.ended {
+		t.Errorf("unexpected span: %+v", span)
+	}
+}
+
+func TestToHCL(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"region": "us-east-1", "count": 3, "zones": ["a", "b"], "tags": {"env": "prod", "note": "cost ${x}"}, "rules": [{"port": 80}], "empty": null}`), "json"))
+	buf, err := c.ToHCL()
+	if err != nil {
+		t.Fatalf("unable to write hcl: %s", err)
+	}
+	expected := `count = 3
+empty = null
+region = "us-east-1"
+rules = [{
+  "port" = 80
+}]
+zones = ["a", "b"]
+tags {
+  env = "prod"
+  note = "cost $${x}"
+}
+`
+	if string(buf) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, buf)
+	}
+	c.MergeFlatMap(map[string]interface{}{"bad key": 1})
+	if _, err := c.Bytes("hcl"); err == nil {
+		t.Errorf("invalid identifier should fail")
+	}
+}
+
+func TestMergeStrategy(t *testing.T) {
+	load := func(opts ...Option) map[string]interface{} {
+		c := NewConfig(opts...)
+		c.AddSource(NewBufSource([]byte(`{"plugins": ["a", "b"], "hosts": ["x"]}`), "json"))
+		c.AddSource(NewBufSource([]byte(`{"plugins": ["b", "c"], "hosts": ["y"]}`), "json"))
+		c.AddSource(NewBufSource([]byte(`{"other": 1}`), "json"))
+		return c.ToFlatMap()
+	}
+	if fm := load(); fmt.Sprint(fm["plugins"], fm["hosts"]) != "[b c] [y]" {
+		t.Errorf("lists should be replaced by default: %v", fm)
+	}
+	if fm := load(WithMergeStrategy(MergeAppend)); fmt.Sprint(fm["plugins"], fm["hosts"]) != "[a b b c] [x y]" {
+		t.Errorf("lists should be appended: %v", fm)
+	}
+	if fm := load(WithKeyMergeStrategy("Plugins", MergeUnion)); fmt.Sprint(fm["plugins"], fm["hosts"]) != "[a b c] [y]" {
+		t.Errorf("plugins should be merged as a union: %v", fm)
+	}
+}
+
+func TestTOML(t *testing.T) {
+	buf := `title = "app"
+
+[server]
+host = "localhost"
+port = 8080
+hosts = ["a", "b"]
+
+[server.tls]
+cert = "c.pem"
+
+[[plugins]]
+name = "auth"
+
+[[plugins]]
+name = "cache"
+`
+	c := NewConfig()
+	if err := c.AddSource(NewBufSource([]byte(buf), "toml")); err != nil {
+		t.Fatalf("unable to add toml source: %s", err)
+	}
+	fm := c.ToFlatMap()
+	if fm["title"] != "app" || fm["server.port"] != int64(8080) || fm["server.tls.cert"] != "c.pem" || fmt.Sprint(fm["server.hosts"]) != "[a b]" {
+		t.Errorf("unexpected toml: %v", fm)
+	}
+	var s struct {
+		Plugins []struct{ Name string }
+	}
+	c.Unmarshal("", &s)
+	if len(s.Plugins) != 2 || s.Plugins[1].Name != "cache" {
+		t.Errorf("array of tables should be a list of maps: %v", fm["plugins"])
+	}
+}
+
+func TestIni(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.conf")
+	ioutil.WriteFile(path, []byte(`; global settings
+name = app
+
+[database]
+host = localhost
+port: 5432
+
+# again
+[database]
+user = "admin"
+`), 0644)
+	c := NewConfig()
+	if err := c.AddSource(NewIniSource(path)); err != nil {
+		t.Fatalf("unable to add ini source: %s", err)
+	}
+	if fmt.Sprint(c.ToFlatMap()) != "map[database.host:localhost database.port:5432 database.user:admin name:app]" {
+		t.Errorf("unexpected ini: %v", c.ToFlatMap())
+	}
+	if err := c.AddSource(NewBufSource([]byte("[broken"), "ini")); err == nil {
+		t.Errorf("broken ini should fail")
+	}
+	c = NewConfig()
+	c.AddSource(NewBufSource([]byte("a = 1\n[a]\nb = 2"), "ini"))
+	if fmt.Sprint(c.ToFlatMap()) != "map[a:1 a.b:2]" {
+		t.Errorf("a global key should be kept with its section: %v", c.ToFlatMap())
+	}
+}
+
+func TestProperties(t *testing.T) {
+	buf := `# comment
+! also a comment
+app.name = My App
+app.port:8080
+app.description = a long \
+    description
+app.path=c:\\temp
+key\ with\ spaces = \u00e9t\u00e9
+empty
+`
+	c := NewConfig()
+	if err := c.AddSource(NewBufSource([]byte(buf), "properties")); err != nil {
+		t.Fatalf("unable to add properties source: %s", err)
+	}
+	expected := `map[app.description:a long description app.name:My App app.path:c:\temp app.port:8080 empty: key with spaces:été]`
+	if fmt.Sprint(c.ToFlatMap()) != expected {
+		t.Errorf("expected %s, got %v", expected, c.ToFlatMap())
+	}
+	out, err := c.ToProperties()
+	if err != nil {
+		t.Fatalf("unable to write properties: %s", err)
+	}
+	back := NewConfig()
+	back.AddSource(NewBufSource(out, "properties"))
+	if fmt.Sprint(back.ToFlatMap()) != expected {
+		t.Errorf("properties should round trip: %v", back.ToFlatMap())
+	}
+	c = NewConfig(WithSeparator("/"))
+	c.AddSource(NewBufSource([]byte("logging.level=INFO\nlogging.level.root=DEBUG"), "properties"))
+	if fmt.Sprint(c.ToFlatMap()) != "map[logging/level:INFO logging/level/root:DEBUG]" {
+		t.Errorf("a parent key should be kept with its child: %v", c.ToFlatMap())
+	}
+	c = NewConfig()
+	err = c.AddSource(NewBufSource([]byte("logging.level=INFO\nlogging.level.root=DEBUG"), "properties", WithIncludes()))
+	if !errors.Is(err, ErrParse) || !strings.Contains(err.Error(), "logging.level is both a value and the parent of logging.level.root") {
+		t.Errorf("a parent key with includes should be an error: %v", err)
+	}
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
+
+func TestReader(t *testing.T) {
+	c := NewConfig()
+	if err := c.AddSource(NewReaderSource(strings.NewReader("a:\n  b: 1"), "yaml")); err != nil {
+		t.Fatalf("unable to add reader source: %s", err)
+	}
+	if c.ToFlatMap()["a.b"] != 1.0 {
+		t.Errorf("reader not loaded: %v", c.ToFlatMap())
+	}
+	err := c.AddSource(NewReaderSource(failingReader{}, "yaml"))
+	if err == nil || err.Error() != "cannot read reader: connection reset" {
+		t.Errorf("read error should be wrapped, got: %v", err)
+	}
+	err = c.AddSource(NewReaderSource(strings.NewReader(`{"a": 1}`), "json", WithMaxBytes(4)))
+	if err == nil {
+		t.Errorf("too large reader should fail")
+	}
+	r := NewReaderSource(strings.NewReader(`{"a": 1}`), "json")
+	c.Rebuild(r)
+	if err := c.Rebuild(r); err != nil || c.ToFlatMap()["a"] != 1.0 {
+		t.Errorf("reader should be read once, and reloaded from its content: %v (%v)", c.ToFlatMap(), err)
+	}
+}
+
+func TestMapSource(t *testing.T) {
+	d := 5 * time.Second
+	c := NewConfig()
+	err := c.AddSource(NewMapSource(map[string]interface{}{
+		"db.Port": 5432,
+		"db":      map[string]interface{}{"host": "localhost", "pool": map[string]interface{}{"timeout": d}},
+		"tags":    []string{"a"},
+	}))
+	if err != nil {
+		t.Fatalf("unable to add map source: %s", err)
+	}
+	fm := c.ToFlatMap()
+	if len(fm) != 4 || fm["db.port"] != 5432 || fm["db.host"] != "localhost" || fm["db.pool.timeout"] != d || fmt.Sprint(fm["tags"]) != "[a]" {
+		t.Errorf("unexpected map source: %v", fm)
+	}
+}
+
+func TestFSSource(t *testing.T) {
+	fsys := fstest.MapFS{"config/app.yaml": {Data: []byte("db:\n  port: 5432")}}
+	c := NewConfig()
+	if err := c.AddSource(NewFSSource(fsys, "config/app.yaml")); err != nil {
+		t.Fatalf("unable to add fs source: %s", err)
+	}
+	if c.ToFlatMap()["db.port"] != 5432.0 {
+		t.Errorf("fs file not loaded: %v", c.ToFlatMap())
+	}
+	if err := c.AddSource(NewFSSource(fsys, "config/missing.yaml")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("missing file should be ErrNotFound, got: %v", err)
+	}
+}
+
+func TestGlob(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "b.yaml"), []byte("a: 2\nb: 2"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a.yaml"), []byte("a: 1"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "c.json"), []byte(`{"a": 3}`), 0644)
+	c := NewConfig()
+	if err := c.AddSource(NewGlobSource(filepath.Join(dir, "*.yaml"))); err != nil {
+		t.Fatalf("unable to add glob source: %s", err)
+	}
+	if fmt.Sprint(c.ToFlatMap()) != "map[a:2 b:2]" {
+		t.Errorf("matches should be loaded in order: %v", c.ToFlatMap())
+	}
+	err = c.AddSource(NewGlobSource(filepath.Join(dir, "*.toml")))
+	if !errors.Is(err, ErrNoMatch) || errors.Is(err, ErrNotFound) {
+		t.Errorf("no match should be ErrNoMatch, got: %v", err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "d.yaml"), []byte("a: ["), 0644)
+	err = c.AddSource(NewGlobSource(filepath.Join(dir, "*.yaml")))
+	if !errors.Is(err, ErrParse) {
+		t.Errorf("broken match should be ErrParse, got: %v", err)
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/config":
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.Write([]byte(`{"a": {"b": 1}}`))
+		case "/config.yaml":
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("a:\n  c: 2"))
+		case "/slow":
+			time.Sleep(time.Second)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	c := NewConfig()
+	if err := c.AddSource(NewHTTPSource(server.URL + "/config")); err != nil {
+		t.Fatalf("unable to add http source: %s", err)
+	}
+	if err := c.AddSource(NewHTTPSource(server.URL+"/config.yaml?v=1", WithHTTPClient(server.Client()))); err != nil {
+		t.Fatalf("unable to add http source with extension: %s", err)
+	}
+	if m := c.ToFlatMap(); m["a.b"] != 1.0 || m["a.c"] != 2.0 {
+		t.Errorf("http sources not loaded: %v", m)
+	}
+	err := c.AddSource(NewHTTPSource(server.URL + "/missing.json"))
+	if !errors.Is(err, ErrNotFound) || !strings.Contains(err.Error(), "404") {
+		t.Errorf("missing url should be ErrNotFound, got: %v", err)
+	}
+	err = c.AddSource(NewHTTPSource(server.URL+"/slow", WithHTTPSourceOptions(WithTimeout(50*time.Millisecond))))
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("slow url should time out, got: %v", err)
+	}
+}
+
+func TestFlattenSiblings(t *testing.T) {
+	m := map[string]interface{}{
+		"a": map[string]interface{}{
+			"b": map[string]interface{}{"c": 1, "d": 2, "e": 3},
+			"f": map[string]interface{}{"g": 4, "h": 5, "i": 6},
+		},
+	}
+	var paths [][]string
+	flattenrec(m, make([]string, 0, 8), func(keys []string, value interface{}) {
+		paths = append(paths, keys)
+	})
+	var got []string
+	for _, keys := range paths {
+		got = append(got, strings.Join(keys, "."))
+	}
+	sort.Strings(got)
+	want := "a.b.c a.b.d a.b.e a.f.g a.f.h a.f.i"
+	if strings.Join(got, " ") != want {
+		t.Errorf("expected keys %s, got %v", want, got)
+	}
+}
+
+func TestJSONStrict(t *testing.T) {
+	var syntaxErr *json.SyntaxError
+	_, err := readBuf([]byte(`{"a": 1,}`), "json", ".")
+	if !errors.Is(err, ErrParse) || !errors.As(err, &syntaxErr) {
+		t.Errorf("malformed json should be a json syntax error, got: %v", err)
+	}
+	_, err = readBuf([]byte("a: 1\nb: [2, 3]"), "json", ".")
+	if !errors.Is(err, ErrParse) {
+		t.Errorf("yaml in a json buf should fail, got: %v", err)
+	}
+	m, err := readBuf([]byte("a: 1\nb: [2, 3]"), "yaml", ".")
+	if err != nil || m["a"] != 1.0 {
+		t.Errorf("yaml buf not read: %v, %v", m, err)
+	}
+}
+
+func TestTypedGetters(t *testing.T) {
+	c := NewConfig()
+	os.Setenv("PORT", "42")
+	defer os.Unsetenv("PORT")
+	c.AddSource(NewEnvSource())
+	c.AddSource(NewBufSource([]byte(`{"name": "app", "debug": "true", "ratio": 0.5, "workers": 4}`), "json"))
+	if i, ok := c.GetInt("port"); !ok || i != 42 {
+		t.Errorf("expected port 42, got %v, %v", i, ok)
+	}
+	if s, ok := c.GetString("name"); !ok || s != "app" {
+		t.Errorf("expected name app, got %v, %v", s, ok)
+	}
+	if s, ok := c.GetString("workers"); !ok || s != "4" {
+		t.Errorf("expected workers \"4\", got %v, %v", s, ok)
+	}
+	if b, ok := c.GetBool("debug"); !ok || !b {
+		t.Errorf("expected debug true, got %v, %v", b, ok)
+	}
+	if f, ok := c.GetFloat64("ratio"); !ok || f != 0.5 {
+		t.Errorf("expected ratio 0.5, got %v, %v", f, ok)
+	}
+	if i, ok := c.GetInt("missing"); ok || i != 0 {
+		t.Errorf("missing key should not be found, got %v, %v", i, ok)
+	}
+	if _, ok := c.GetInt("name"); ok {
+		t.Errorf("name should not convert to an int")
+	}
+}
+
+func TestGetDuration(t *testing.T) {
+	os.Setenv("HTTP_TIMEOUT", "30s")
+	defer os.Unsetenv("HTTP_TIMEOUT")
+	c := NewConfig()
+	c.AddSource(NewEnvSource())
+	c.AddSource(NewBufSource([]byte(`{"retry": 1000, "bad": "soon"}`), "json"))
+	if d, err := c.GetDuration("http.timeout"); err != nil || d != 30*time.Second {
+		t.Errorf("expected 30s, got %v, %v", d, err)
+	}
+	if d, err := c.GetDuration("retry"); err != nil || d != time.Microsecond {
+		t.Errorf("expected 1µs, got %v, %v", d, err)
+	}
+	if d, err := c.GetDuration("missing"); err != nil || d != 0 {
+		t.Errorf("expected 0 for a missing key, got %v, %v", d, err)
+	}
+	if _, err := c.GetDuration("bad"); err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("expected an error naming the key, got %v", err)
+	}
+}
+
+func TestSet(t *testing.T) {
+	c := NewConfig()
+	c.AddNamedSource("file", NewBufSource([]byte(`{"server": {"host": "a.com", "port": 80}}`), "json"))
+	c.Set("Server.Port", 9090)
+	c.Set("db", map[string]interface{}{"user": "me", "pool": map[string]interface{}{"size": 4}})
+	fm := c.ToFlatMap()
+	if fm["server.port"] != 9090 || fm["server.host"] != "a.com" || fm["db.user"] != "me" || fm["db.pool.size"] != 4 {
+		t.Errorf("keys not set: %v", fm)
+	}
+	hm := c.ToHierarchicalMap()
+	if hm["db"].(map[string]interface{})["pool"].(map[string]interface{})["size"] != 4 {
+		t.Errorf("set map not in hierarchy: %v", hm)
+	}
+	var server struct {
+		Host string
+		Port int
+	}
+	if err := c.Unmarshal("server", &server); err != nil || server.Port != 9090 {
+		t.Errorf("set key not unmarshalled: %+v, %v", server, err)
+	}
+	if err := c.ReplaceSource("file", NewBufSource([]byte(`{"server": {"host": "b.com", "port": 81}}`), "json")); err != nil {
+		t.Fatalf("unable to replace source: %s", err)
+	}
+	if fm := c.ToFlatMap(); fm["server.port"] != 9090 || fm["server.host"] != "b.com" {
+		t.Errorf("set key lost on replace: %v", fm)
+	}
+	if e := c.Explain(); e[len(e)-1].Key != "server.port" || e[len(e)-1].Winner != "set" {
+		t.Errorf("set key not explained: %v", e)
+	}
+	for i := 0; i < 100; i++ {
+		c.Set("n", i)
+	}
+	if c.String() != "gonfic.Config{keys: 5, sources: 2}" {
+		t.Errorf("consecutive sets should be kept as one step: %s", c)
+	}
+}
+
+func TestPrefixCase(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"app": {"name": "x", "hosts": ["a"]}}`), "json"))
+	var app struct{ Name string }
+	if err := c.Unmarshal("App", &app); err != nil || app.Name != "x" {
+		t.Errorf("prefix should be case insensitive: %+v, %v", app, err)
+	}
+	if err := c.Unmarshal("App", &app, WithBranchOnly()); err != nil || app.Name != "x" {
+		t.Errorf("branch only prefix should be case insensitive: %+v, %v", app, err)
+	}
+	if m := c.GetStringMap("APP"); m["name"] != "x" {
+		t.Errorf("map prefix should be case insensitive: %v", m)
+	}
+	if m := c.GetStringMapString("App."); m["name"] != "x" {
+		t.Errorf("map prefix should be case insensitive: %v", m)
+	}
+	if m := c.GetStringMapStringSlice("App"); len(m["hosts"]) != 1 {
+		t.Errorf("map prefix should be case insensitive: %v", m)
+	}
+}
+
+func TestUnset(t *testing.T) {
+	c := NewConfig()
+	c.SetDefault("db.host", "localhost")
+	c.AddNamedSource("file", NewBufSource([]byte(`{"db": {"host": "a.com", "pool": {"size": 4}}, "dbx": 1}`), "json"))
+	c.Unset("DB")
+	if fmt.Sprint(c.ToFlatMap()) != "map[db.host:localhost dbx:1]" {
+		t.Errorf("key and subkeys not unset: %v", c.ToFlatMap())
+	}
+	if origin, _ := c.Origin("db.host"); origin != "default" {
+		t.Errorf("unset key should fall back to its default, got: %s", origin)
+	}
+	if err := c.ReplaceSource("file", NewBufSource([]byte(`{"db": {"host": "b.com", "user": "me"}}`), "json")); err != nil {
+		t.Fatalf("unable to replace source: %s", err)
+	}
+	if fmt.Sprint(c.ToFlatMap()) != "map[db.host:localhost]" {
+		t.Errorf("unset keys should stay unset on replace: %v", c.ToFlatMap())
+	}
+	c.Set("db.port", 5432)
+	if port, ok := c.Get("db.port"); !ok || port != 5432 {
+		t.Errorf("key set after unset should be set: %v", port)
+	}
+}
+
+func TestSetReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "app.json")
+	ioutil.WriteFile(path, []byte(`{"host": "a.com", "port": 80}`), 0644)
+	c := NewConfig()
+	c.AddSource(NewFileSource(path))
+	c.Set("port", 9090)
+	ioutil.WriteFile(path, []byte(`{"host": "b.com", "port": 81}`), 0644)
+	if err := c.reload(); err != nil {
+		t.Fatalf("unable to reload: %s", err)
+	}
+	if fm := c.ToFlatMap(); fm["port"] != 9090 || fm["host"] != "b.com" {
+		t.Errorf("set key lost on reload: %v", fm)
+	}
+	if err := c.Rebuild(NewBufSource([]byte(`{"host": "c.com", "port": 82}`), "json")); err != nil {
+		t.Fatalf("unable to rebuild: %s", err)
+	}
+	if fm := c.ToFlatMap(); fm["port"] != 9090 || fm["host"] != "c.com" {
+		t.Errorf("set key lost on rebuild: %v", fm)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"database": {"host": "h", "port": 1}, "databases": 2, "app": null}`), "json"))
+	if !c.Has("database.host") || !c.Has("Database.Port") || !c.Has("app") || c.Has("database") {
+		t.Errorf("unexpected Has results")
+	}
+	if keys := strings.Join(c.Keys(), " "); keys != "app database.host database.port databases" {
+		t.Errorf("unexpected keys: %s", keys)
+	}
+	if keys := strings.Join(c.KeysWithPrefix("database."), " "); keys != "database.host database.port" {
+		t.Errorf("unexpected keys under database: %s", keys)
+	}
+	if keys := c.KeysWithPrefix("nope"); keys == nil || len(keys) != 0 {
+		t.Errorf("expected no keys, got %v", keys)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	defaults := NewConfig()
+	defaults.AddSource(NewBufSource([]byte(`{"server": {"host": "localhost", "port": 80}, "debug": false}`), "json"))
+	user := NewConfig()
+	user.SetDefault("log.level", "info")
+	user.AddSource(NewBufSource([]byte(`{"server": {"port": 8080}, "debug": true}`), "json"))
+	defaults.Merge(user)
+	fm := defaults.ToFlatMap()
+	if fm["server.host"] != "localhost" || fm["server.port"] != 8080.0 || fm["debug"] != true || fm["log.level"] != "info" {
+		t.Errorf("unexpected merged config: %v", fm)
+	}
+	if user.Has("server.host") {
+		t.Errorf("merged config should be left untouched")
+	}
+	if e := defaults.Explain(); e[0].Key != "debug" || e[0].Winner != "merge" {
+		t.Errorf("merged key not explained: %v", e)
+	}
+}
+
+func TestSub(t *testing.T) {
+	c := NewConfig()
+	c.SetDefault("database.pool", 4)
+	c.AddSource(NewBufSource([]byte(`{"database": {"host": "h", "port": "5432"}, "databases": 2}`), "json"))
+	sub := c.Sub("Database")
+	fm := sub.ToFlatMap()
+	if len(fm) != 3 || fm["host"] != "h" || fm["pool"] != 4 {
+		t.Errorf("unexpected sub config: %v", fm)
+	}
+	if port, ok := sub.GetInt("port"); !ok || port != 5432 {
+		t.Errorf("expected port 5432, got %v, %v", port, ok)
+	}
+	if e := sub.Explain(); e[0].Key != "host" || e[0].Winner != "buf:json" {
+		t.Errorf("sub keys not explained: %v", e)
+	}
+	sub.Set("host", "other")
+	if c.ToFlatMap()["database.host"] != "h" {
+		t.Errorf("config should be left untouched")
+	}
+	if empty := c.Sub("nope"); empty == nil || !empty.IsEmpty() {
+		t.Errorf("expected an empty config, got %v", empty)
+	}
+}
+
+func TestIndexedKeys(t *testing.T) {
+	os.Setenv("SERVERS_1_HOST", "b.example.com")
+	defer os.Unsetenv("SERVERS_1_HOST")
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"servers": [{"host": "a.com", "port": 1}, {"host": "b.com", "port": 2}]}`), "json"))
+	c.AddSource(NewEnvSource())
+	var config struct {
+		Servers []struct {
+			Host string
+			Port int
+		}
+	}
+	if err := c.Unmarshal("", &config); err != nil {
+		t.Fatalf("unable to unmarshal: %s", err)
+	}
+	if len(config.Servers) != 2 || config.Servers[0].Host != "a.com" || config.Servers[1].Host != "b.example.com" || config.Servers[1].Port != 2 {
+		t.Errorf("element not overridden: %+v", config.Servers)
+	}
+	var server struct{ Host string }
+	if err := c.Unmarshal("servers.1", &server); err != nil || server.Host != "b.example.com" {
+		t.Errorf("element not unmarshalled: %+v, %v", server, err)
+	}
+	if host, ok := c.GetString("servers.1.host"); !ok || host != "b.example.com" {
+		t.Errorf("element not got by index: %v", host)
+	}
+	if port, ok := c.GetInt("Servers.0.Port"); !ok || port != 1 {
+		t.Errorf("element not got by index: %v", port)
+	}
+	if c.Has("servers.2.host") || c.Has("servers.x") || c.Has("servers.0.user") {
+		t.Errorf("missing elements should not be set")
+	}
+	if keys := strings.Join(c.KeysWithPrefix("servers"), " "); keys != "servers.1.host" {
+		t.Errorf("list elements should not be listed as keys: %s", keys)
+	}
+	c.AddSource(NewBufSource([]byte(`{"servers": [{"host": "c.com"}]}`), "json"))
+	hm := c.ToHierarchicalMap()
+	if servers, ok := hm["servers"].([]interface{}); !ok || len(servers) != 1 {
+		t.Errorf("new list should drop previous element overrides: %v", hm)
+	}
+	m := unflatten(map[string]interface{}{
+		"list": []interface{}{"a", "b"}, "list.1": "x",
+		"sparse": []interface{}{"a"}, "sparse.2": "c",
+		"nested": []interface{}{map[string]interface{}{"hosts": []interface{}{"a", "b"}}}, "nested.0.hosts.1": "x",
+		"numeric.0": "a", "numeric.1": "b",
+		"mixed.0": "a", "mixed.x": "b",
+	}, dotSlicer)
+	if list, ok := m["list"].([]interface{}); !ok || len(list) != 2 || list[1] != "x" {
+		t.Errorf("overridden list should stay a list: %v", m["list"])
+	}
+	if fmt.Sprint(m["nested"]) != "[map[hosts:[a x]]]" {
+		t.Errorf("nested overridden lists should stay lists: %v", m["nested"])
+	}
+	if fmt.Sprint(m["numeric"]) != "[a b]" {
+		t.Errorf("consecutive indices should be a list: %v", m["numeric"])
+	}
+	for _, key := range []string{"sparse", "mixed"} {
+		if _, ok := m[key].(map[string]interface{}); !ok {
+			t.Errorf("%s should be a map: %v", key, m[key])
+		}
+	}
+	c = NewConfig()
+	c.AddSource(NewBufSource([]byte("retries: {\"0\": fast, \"1\": slow}"), "yaml"))
+	var retries struct{ Retries map[string]string }
+	if err := c.Unmarshal("", &retries); err != nil || retries.Retries["1"] != "slow" {
+		t.Errorf("map with numeric keys should stay a map: %+v, %v", retries, err)
+	}
+	c = NewConfig()
+	c.MergeFlatMap(map[string]interface{}{"plugins.0": "auth", "plugins.1": "log"})
+	var plugins struct{ Plugins []string }
+	if err := c.Unmarshal("", &plugins); err != nil || fmt.Sprint(plugins.Plugins) != "[auth log]" {
+		t.Errorf("indexed keys should unmarshal as a list: %+v, %v", plugins, err)
+	}
+}
+
+func TestSeparator(t *testing.T) {
+	os.Setenv("HOSTS_API_PORT", "8080")
+	defer os.Unsetenv("HOSTS_API_PORT")
+	c := NewConfig(WithSeparator("/"))
+	c.AddSource(NewBufSource([]byte("hosts:\n  example.com:\n    port: 80\n  api:\n    port: 81\nversions: {v1.2: true}"), "yaml"))
+	c.AddSource(NewEnvSource())
+	c.AddSource(NewMapSource(map[string]interface{}{"db": map[string]interface{}{"host": "h.local"}}))
+	c.SetDefault("log", map[string]interface{}{"level": "info"})
+	fm := c.ToFlatMap()
+	if fm["hosts/example.com/port"] != 80.0 || fm["hosts/api/port"] != "8080" || fm["versions/v1.2"] != true || fm["db/host"] != "h.local" || fm["log/level"] != "info" {
+		t.Errorf("unexpected flat map: %v", fm)
+	}
+	hm := c.ToHierarchicalMap()
+	hosts := hm["hosts"].(map[string]interface{})
+	if hosts["example.com"].(map[string]interface{})["port"] != 80.0 {
+		t.Errorf("unexpected hierarchical map: %v", hm)
+	}
+	var example struct{ Port int }
+	if err := c.Unmarshal("hosts/example.com", &example); err != nil || example.Port != 80 {
+		t.Errorf("prefix not unmarshalled: %+v, %v", example, err)
+	}
+	if keys := strings.Join(c.KeysWithPrefix("hosts"), " "); keys != "hosts/api/port hosts/example.com/port" {
+		t.Errorf("unexpected keys under hosts: %s", keys)
+	}
+	if port, ok := c.Sub("hosts/example.com").GetInt("port"); !ok || port != 80 {
+		t.Errorf("unexpected sub config port: %v", port)
+	}
+	buf, err := c.Bytes("json")
+	if err != nil {
+		t.Fatalf("unable to write config: %s", err)
+	}
+	rt := NewConfig(WithSeparator("/"))
+	rt.AddSource(NewBufSource(buf, "json"))
+	if !reflect.DeepEqual(rt.ToFlatMap(), fm) {
+		t.Errorf("config did not round trip: %v", rt.ToFlatMap())
+	}
+}
+
+func TestEscapedSeparator(t *testing.T) {
+	doc := "hosts:\n  example.com:\n    port: 80\n  api.example.com:\n    port: 81\n  local:\n    port: 82\npaths:\n  'c:\\tmp': 1"
+	c := NewConfig()
+	if err := c.AddSource(NewBufSource([]byte(doc), "yaml")); err != nil {
+		t.Fatalf("unable to add source: %s", err)
+	}
+	fm := c.ToFlatMap()
+	if fm[`hosts.example\.com.port`] != 80.0 || fm[`hosts.api\.example\.com.port`] != 81.0 || fm["hosts.local.port"] != 82.0 || fm[`paths.c:\\tmp`] != 1.0 {
+		t.Errorf("unexpected flat map: %v", fm)
+	}
+	var want map[string]interface{}
+	if err := yaml.Unmarshal([]byte(doc), &want); err != nil {
+		t.Fatalf("unable to parse yaml: %s", err)
+	}
+	if hm := c.ToHierarchicalMap(); !reflect.DeepEqual(hm, want) {
+		t.Errorf("expected %v, got %v", want, hm)
+	}
+	var host struct{ Port int }
+	if err := c.Unmarshal(`hosts.example\.com`, &host); err != nil || host.Port != 80 {
+		t.Errorf("escaped prefix not unmarshalled: %+v, %v", host, err)
+	}
+	c.Set(`hosts.example\.com.port`, 8080)
+	if port, ok := c.GetInt(`hosts.example\.com.port`); !ok || port != 8080 {
+		t.Errorf("escaped key not set: %v", port)
+	}
+}
+
+func TestEnvPrefix(t *testing.T) {
+	os.Setenv("MYAPP_SERVER_PORT", "8080")
+	os.Setenv("MYAPP__LEVEL", "debug")
+	os.Setenv("OTHER_SERVER_PORT", "9090")
+	defer os.Unsetenv("MYAPP_SERVER_PORT")
+	defer os.Unsetenv("MYAPP__LEVEL")
+	defer os.Unsetenv("OTHER_SERVER_PORT")
+	c := NewConfig()
+	if err := c.AddSource(NewEnvSourceWithPrefix("myapp")); err != nil {
+		t.Fatalf("unable to add env source: %s", err)
+	}
+	fm := c.ToFlatMap()
+	if fm["server.port"] != "8080" || c.Has("other.server.port") || c.Has("myapp.server.port") {
+		t.Errorf("unexpected env config: %v", fm)
+	}
+	c = NewConfig()
+	c.AddSource(NewEnvSourceWithPrefix("MYAPP", WithEnvNestingDelimiter("__")))
+	if fm := c.ToFlatMap(); len(fm) != 1 || fm["level"] != "debug" {
+		t.Errorf("unexpected env config with __: %v", fm)
+	}
+}
+
+func TestEnvKeyOptions(t *testing.T) {
+	os.Setenv("GONFIC__SERVER__DB_HOST", "h")
+	defer os.Unsetenv("GONFIC__SERVER__DB_HOST")
+	c := NewConfig()
+	c.AddSource(NewEnvSourceWithPrefix("GONFIC", WithEnvNestingDelimiter("__")))
+	if v, _ := c.GetString("server.db_host"); v != "h" {
+		t.Errorf("expected server.db_host, got %v", c.ToFlatMap())
+	}
+	c = NewConfig()
+	c.AddSource(NewEnvSourceWithPrefix("GONFIC", WithEnvNestingDelimiter("__"), WithEnvKeySeparator("/"), WithEnvKeepCase()))
+	if fm := c.ToFlatMap(); len(fm) != 1 || fm["SERVER/DB_HOST"] != "h" {
+		t.Errorf("expected SERVER/DB_HOST, got %v", fm)
+	}
+}
+
+func TestResolve(t *testing.T) {
+	c := NewConfig()
+	c.SetDefault("app.home", "/opt/app")
+	c.AddSource(NewBufSource([]byte(`{"log": {"dir": "${app.home}/log", "file": "${log.dir}/app.log"}, "port": 80, "url": "http://h:${port}", "same": "${port}", "price": "$${amount}"}`), "json"))
+	if err := c.Resolve(); err != nil {
+		t.Fatalf("unable to resolve: %s", err)
+	}
+	fm := c.ToFlatMap()
+	if fm["log.file"] != "/opt/app/log/app.log" || fm["url"] != "http://h:80" || fm["same"] != 80.0 || fm["price"] != "${amount}" {
+		t.Errorf("unexpected resolved config: %v", fm)
+	}
+	c = NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"a": "${b}", "b": "x${c}", "c": "${a}"}`), "json"))
+	err := c.Resolve()
+	if err == nil || !strings.Contains(err.Error(), "interpolation cycle: a -> b -> c -> a") {
+		t.Errorf("expected a cycle error, got: %v", err)
+	}
+	if c.ToFlatMap()["a"] != "${b}" {
+		t.Errorf("failed resolve should leave the config untouched")
+	}
+	c = NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"a": "${missing}/x"}`), "json"))
+	if err := c.Resolve(); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Errorf("expected a missing key error, got: %v", err)
+	}
+	if err := c.Resolve(WithUnresolvedLiteral()); err != nil || c.ToFlatMap()["a"] != "${missing}/x" {
+		t.Errorf("missing key should be left literal: %v, %v", c.ToFlatMap(), err)
+	}
+	c = NewConfig()
+	c.SetDefault("log.dir", "${home}/log")
+	c.AddNamedSource("app", NewBufSource([]byte(`{"home": "/a", "log": {"file": "${log.dir}/app.log"}}`), "json"))
+	if err := c.Resolve(); err != nil {
+		t.Fatalf("unable to resolve: %s", err)
+	}
+	if origin, _ := c.Origin("log.dir"); origin != "resolve" {
+		t.Errorf("resolved value should come from resolve, got: %s", origin)
+	}
+	if err := c.ReplaceSource("app", NewBufSource([]byte(`{"home": "/b", "log": {"file": "${log.dir}/app.log"}}`), "json")); err != nil {
+		t.Fatalf("unable to replace source: %s", err)
+	}
+	if fm := c.ToFlatMap(); fm["log.file"] != "/b/log/app.log" || fm["log.dir"] != "/b/log" {
+		t.Errorf("replaced source should be resolved again: %v", fm)
+	}
+	if err := c.Rebuild(NewBufSource([]byte(`{"home": "/c", "log": {"file": "${log.dir}/c.log"}}`), "json")); err != nil {
+		t.Fatalf("unable to rebuild: %s", err)
+	}
+	if fm := c.ToFlatMap(); fm["log.file"] != "/c/log/c.log" {
+		t.Errorf("rebuilt config should be resolved again: %v", fm)
+	}
+}
+
+func TestResolveEnv(t *testing.T) {
+	os.Setenv("GONFIC_HOME", "/home/me")
+	os.Unsetenv("GONFIC_PORT")
+	defer os.Unsetenv("GONFIC_HOME")
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"home": "${ENV:GONFIC_HOME}", "port": "${ENV:GONFIC_PORT:-8080}", "dir": "${missing:-/tmp}", "path": "$GONFIC_HOME/bin", "price": "$$5", "GONFIC_HOME": "key"}`), "json"))
+	if err := c.Resolve(); err != nil {
+		t.Fatalf("unable to resolve: %s", err)
+	}
+	fm := c.ToFlatMap()
+	if fm["home"] != "/home/me" || fm["port"] != "8080" || fm["dir"] != "/tmp" || fm["path"] != "$GONFIC_HOME/bin" || fm["price"] != "$$5" {
+		t.Errorf("unexpected resolved config: %v", fm)
+	}
+	if err := c.Resolve(WithBareEnv()); err != nil {
+		t.Fatalf("unable to resolve bare env: %s", err)
+	}
+	if fm := c.ToFlatMap(); fm["path"] != "/home/me/bin" || fm["price"] != "$5" {
+		t.Errorf("unexpected resolved config with bare env: %v", fm)
+	}
+	c = NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"port": "${ENV:GONFIC_PORT}"}`), "json"))
+	if err := c.Resolve(); err == nil || !strings.Contains(err.Error(), "GONFIC_PORT is not set") {
+		t.Errorf("expected an unset variable error, got: %v", err)
+	}
+}
+
+func TestUnmarshalStrict(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"server": {"host": "h", "port": "80", "hots": "x", "tls": {"enabled": true}}}`), "json"))
+	var server struct {
+		Host string
+		Port int
+	}
+	if err := c.Unmarshal("server", &server); err != nil {
+		t.Errorf("lenient unmarshal should ignore unknown keys: %s", err)
+	}
+	err := c.UnmarshalStrict("server", &server)
+	if err == nil || !strings.Contains(err.Error(), "hots") || !strings.Contains(err.Error(), "tls") {
+		t.Errorf("expected an error listing unknown keys, got: %v", err)
+	}
+	var all struct {
+		Server struct {
+			Host string
+			Port int
+			Hots string
+			TLS  struct{ Enabled bool }
+		}
+	}
+	if err := c.UnmarshalStrict("", &all); err != nil || all.Server.Port != 80 {
+		t.Errorf("strict unmarshal should succeed with every key matched: %+v, %v", all, err)
+	}
+}
+
+func TestDecodeHook(t *testing.T) {
+	type level int
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"endpoint": "https://example.com/api", "level": "debug", "timeout": "fast", "wait": "2s"}`), "json"))
+	c.AddDecodeHook(func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+		if from.Kind() != reflect.String || to != reflect.TypeOf(url.URL{}) {
+			return data, nil
+		}
+		u, err := url.Parse(data.(string))
+		if err != nil {
+			return nil, err
+		}
+		return *u, nil
+	})
+	c.AddDecodeHook(func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+		if from.Kind() == reflect.String && to == reflect.TypeOf(level(0)) {
+			return map[string]level{"debug": 1, "info": 2}[data.(string)], nil
+		}
+		if from.Kind() == reflect.String && to == reflect.TypeOf(time.Duration(0)) && data == "fast" {
+			return time.Millisecond, nil
+		}
+		return data, nil
+	})
+	var v struct {
+		Endpoint url.URL
+		Level    level
+		Timeout  time.Duration
+		Wait     time.Duration
+	}
+	if err := c.Unmarshal("", &v); err != nil {
+		t.Fatalf("unable to unmarshal: %s", err)
+	}
+	if v.Endpoint.Host != "example.com" || v.Level != 1 || v.Timeout != time.Millisecond || v.Wait != 2*time.Second {
+		t.Errorf("unexpected decoded values: %+v", v)
+	}
+}
+
+func TestTimeLayouts(t *testing.T) {
+	os.Setenv("RELEASE_DATE", "02/01/2023")
+	defer os.Unsetenv("RELEASE_DATE")
+	c := NewConfig(WithTimeLayouts("02/01/2006", time.RFC1123))
+	c.AddSource(NewBufSource([]byte(`{"release": {"start": "2023-01-02T15:04:05Z", "end": "Mon, 02 Jan 2023 15:04:05 UTC"}}`), "json"))
+	c.AddSource(NewEnvSource())
+	var release struct {
+		Start time.Time
+		End   time.Time
+		Date  time.Time
+	}
+	if err := c.Unmarshal("release", &release); err != nil {
+		t.Fatalf("unable to unmarshal: %s", err)
+	}
+	want := time.Date(2023, 1, 2, 15, 4, 5, 0, time.UTC)
+	if !release.Start.Equal(want) || !release.End.Equal(want) || !release.Date.Equal(time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected times: %+v", release)
+	}
+	c = NewConfig()
+	c.AddSource(NewEnvSource())
+	if err := c.Unmarshal("release", &release); err == nil {
+		t.Errorf("unknown layout should fail without WithTimeLayouts")
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	os.Setenv("CACHE_DISK", "4GiB")
+	defer os.Unsetenv("CACHE_DISK")
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"cache": {"memory": "256MB", "buffer": "64kib", "block": "512b", "entries": "1000", "ratio": "1.5k", "small": "2Ki"}}`), "json"))
+	c.AddSource(NewEnvSource())
+	var cache struct {
+		Memory  int64
+		Buffer  int
+		Block   uint32
+		Entries int
+		Ratio   int
+		Small   uint
+		Disk    uint64
+	}
+	if err := c.Unmarshal("cache", &cache); err != nil {
+		t.Fatalf("unable to unmarshal: %s", err)
+	}
+	if cache.Memory != 256000000 || cache.Buffer != 65536 || cache.Block != 512 || cache.Entries != 1000 || cache.Ratio != 1500 || cache.Small != 2048 || cache.Disk != 4<<30 {
+		t.Errorf("unexpected sizes: %+v", cache)
+	}
+	var s struct{ Memory string }
+	if err := c.Unmarshal("cache", &s); err != nil || s.Memory != "256MB" {
+		t.Errorf("a size should stay a string for a string: %+v, %v", s, err)
+	}
+	c.Set("cache.memory", "99EB")
+	if err := c.Unmarshal("cache", &cache); err == nil {
+		t.Errorf("too large size should fail")
+	}
+}
+
+func TestListDelimiter(t *testing.T) {
+	os.Setenv("APP_TAGS", "a, b ,c")
+	os.Setenv("APP_PORTS", "80,443")
+	defer os.Unsetenv("APP_TAGS")
+	defer os.Unsetenv("APP_PORTS")
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"app": {"names": ["x,y", "z"], "empty": ""}}`), "json"))
+	c.AddSource(NewEnvSource())
+	var app struct {
+		Tags  []string
+		Ports []int
+		Names []string
+		Empty []string
+	}
+	if err := c.Unmarshal("app", &app); err != nil {
+		t.Fatalf("unable to unmarshal: %s", err)
+	}
+	if fmt.Sprint(app.Tags) != "[a b c]" || fmt.Sprint(app.Ports) != "[80 443]" || len(app.Names) != 2 || app.Empty == nil || len(app.Empty) != 0 {
+		t.Errorf("unexpected lists: %+v", app)
+	}
+	c = NewConfig(WithListDelimiter(";"))
+	c.AddSource(NewBufSource([]byte(`{"tags": "a;b", "hosts": "c,d"}`), "json"))
+	if tags := c.GetStringSliceOr("tags", nil); fmt.Sprint(tags) != "[a b]" {
+		t.Errorf("unexpected tags: %v", tags)
+	}
+	if hosts := c.GetStringSliceOr("hosts", nil); fmt.Sprint(hosts) != "[c,d]" {
+		t.Errorf("unexpected hosts: %v", hosts)
+	}
+}
+
+func TestToJSON(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"b": {"y": [1, 2], "x": "s"}, "a": true}`), "json"))
+	s, err := c.ToJSONString()
+	if err != nil {
+		t.Fatalf("unable to write json: %s", err)
+	}
+	want := "{\n  \"a\": true,\n  \"b\": {\n    \"x\": \"s\",\n    \"y\": [\n      1,\n      2\n    ]\n  }\n}"
+	if s != want {
+		t.Errorf("expected %s, got %s", want, s)
+	}
+	rt := NewConfig()
+	rt.AddSource(NewBufSource([]byte(s), "json"))
+	if !reflect.DeepEqual(rt.ToFlatMap(), c.ToFlatMap()) {
+		t.Errorf("json did not round trip: %v", rt.ToFlatMap())
+	}
+	RegisterMarshalFunc("json", func(v interface{}) ([]byte, error) {
+		return []byte("custom"), nil
+	})
+	defer RegisterMarshalFunc("json", writeJson)
+	if s, err := c.ToJSONString(); err != nil || s != "custom" {
+		t.Errorf("registered json marshal func should be used: %s, %v", s, err)
+	}
+}
+
+func TestToYAML(t *testing.T) {
+	doc := "db:\n  hosts:\n  - a.com\n  - b.com\n  port: 5432\nname: app\nzones:\n  eu: 1\n  us: 2\n"
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(doc), "yaml"))
+	buf, err := c.ToYAML()
+	if err != nil {
+		t.Fatalf("unable to write yaml: %s", err)
+	}
+	if string(buf) != doc {
+		t.Errorf("expected sorted yaml %q, got %q", doc, buf)
+	}
+	rt := NewConfig()
+	rt.AddSource(NewBufSource(buf, "yaml"))
+	if !reflect.DeepEqual(rt.ToHierarchicalMap(), c.ToHierarchicalMap()) {
+		t.Errorf("yaml did not round trip: %v", rt.ToHierarchicalMap())
+	}
+	RegisterMarshalFunc("yaml", func(v interface{}) ([]byte, error) {
+		return []byte("custom"), nil
+	})
+	defer RegisterMarshalFunc("yaml", yaml.Marshal)
+	if buf, err := c.ToYAML(); err != nil || string(buf) != "custom" {
+		t.Errorf("registered yaml marshal func should be used: %s, %v", buf, err)
+	}
+}
+
+func TestWriteToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	c := NewConfig()
+	c.SetDefault("log.level", "info")
+	c.AddSource(NewBufSource([]byte(`{"db": {"port": 5432}}`), "json"))
+	for _, name := range []string{"out.json", "out.yaml", "out.YML"} {
+		path := filepath.Join(dir, name)
+		if err := c.WriteToFile(path); err != nil {
+			t.Fatalf("unable to write %s: %s", name, err)
+		}
+		if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0600 {
+			t.Errorf("unexpected mode for %s: %v (%v)", name, fi.Mode(), err)
+		}
+		rt := NewConfig()
+		if err := rt.AddSource(NewFileSource(path)); err != nil || !reflect.DeepEqual(rt.ToFlatMap(), c.ToFlatMap()) {
+			t.Errorf("%s did not round trip: %v (%v)", name, rt.ToFlatMap(), err)
+		}
+	}
+	err = c.WriteToFile(filepath.Join(dir, "out.xml"))
+	if !errors.Is(err, ErrUnsupportedFormat) || !strings.Contains(err.Error(), "out.xml") {
+		t.Errorf("expected an unsupported format error, got: %v", err)
+	}
+	err = c.WriteToFile(filepath.Join(dir, "missing", "out.json"))
+	if err == nil || !strings.Contains(err.Error(), "out.json") {
+		t.Errorf("expected a write error, got: %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 3 {
+		t.Errorf("temporary files should be removed, got %d files", len(files))
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(path, []byte(`{"a": 1, "b": 2}`), 0644)
+	c := NewConfig()
+	c.AddSource(NewFileSource(path))
+	c.AddSource(NewReaderSource(strings.NewReader(`{"d": 4}`), "json"))
+	c.Set("c", 3)
+	changed := make(chan map[string]interface{}, 10)
+	errs := make(chan error, 10)
+	w, err := c.Watch(func(c *Config, err error) error {
+		if err != nil {
+			errs <- err
+		} else {
+			changed <- c.ToFlatMap()
+		}
+		return nil
+	}, WithDebounce(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unable to watch: %s", err)
+	}
+	defer w.Stop()
+	ioutil.WriteFile(filepath.Join(dir, "other.json"), []byte(`{}`), 0644)
+	ioutil.WriteFile(path, []byte(`{"a": 10`), 0644)
+	ioutil.WriteFile(path, []byte(`{"a": 10}`), 0644)
+	select {
+	case fm := <-changed:
+		if fmt.Sprint(fm) != "map[a:10 c:3 d:4]" {
+			t.Errorf("unexpected reloaded config: %v", fm)
+		}
+	case err := <-errs:
+		t.Fatalf("successive writes should be debounced: %s", err)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("change not seen")
+	}
+	ioutil.WriteFile(path, []byte(`{"a": `), 0644)
+	select {
+	case err := <-errs:
+		if !strings.Contains(err.Error(), "cannot reload") {
+			t.Errorf("unexpected error: %s", err)
+		}
+	case <-changed:
+		t.Fatalf("onChange should be given the error of a failed reload")
+	case <-time.After(5 * time.Second):
+		t.Fatalf("change not seen")
+	}
+	if fmt.Sprint(c.ToFlatMap()) != "map[a:10 c:3 d:4]" {
+		t.Errorf("failed reload should leave the config untouched: %v", c.ToFlatMap())
+	}
+	if err := w.Stop(); err != nil {
+		t.Errorf("unable to stop: %s", err)
+	}
+	ioutil.WriteFile(path, []byte(`{"a": 20}`), 0644)
+	time.Sleep(200 * time.Millisecond)
+	if len(changed) != 0 || c.ToFlatMap()["a"] != 10.0 {
+		t.Errorf("stopped watcher should not reload: %v", c.ToFlatMap())
+	}
+	called := make(chan struct{}, 10)
+	w, err = c.Watch(func(c *Config, err error) error {
+		called <- struct{}{}
+		return errors.New("enough")
+	}, WithDebounce(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unable to watch: %s", err)
+	}
+	ioutil.WriteFile(path, []byte(`{"a": 30}`), 0644)
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("change not seen")
+	}
+	if err := w.Stop(); err == nil || err.Error() != "enough" {
+		t.Errorf("stop should return the error of onChange: %v", err)
+	}
+	ioutil.WriteFile(path, []byte(`{"a": 40}`), 0644)
+	time.Sleep(100 * time.Millisecond)
+	if len(called) != 0 {
+		t.Errorf("onChange error should stop the watch")
+	}
+	var stopped sync.WaitGroup
+	stopped.Add(1)
+	watchers := make(chan *Watcher, 1)
+	w, err = c.Watch(func(c *Config, err error) error {
+		w := <-watchers
+		w.Stop()
+		stopped.Done()
+		return nil
+	}, WithDebounce(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("unable to watch: %s", err)
+	}
+	watchers <- w
+	ioutil.WriteFile(path, []byte(`{"a": 50}`), 0644)
+	stopped.Wait()
+	if err := w.Stop(); err != nil {
+		t.Errorf("unable to stop: %s", err)
+	}
+	select {
+	case <-w.done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("stop from onChange should end the watch")
+	}
+}
+
+func TestAllSettings(t *testing.T) {
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"server": {"hosts": ["a", "b"], "routes": [{"path": "/"}]}}`), "json"))
+	settings := c.AllSettings()
+	server := settings["server"].(map[string]interface{})
+	server["port"] = 80
+	server["hosts"].([]interface{})[0] = "x"
+	server["routes"].([]interface{})[0].(map[string]interface{})["path"] = "/x"
+	if !reflect.DeepEqual(c.ToHierarchicalMap(), map[string]interface{}{"server": map[string]interface{}{
+		"hosts":  []interface{}{"a", "b"},
+		"routes": []interface{}{map[string]interface{}{"path": "/"}},
+	}}) {
+		t.Errorf("modifying the settings should leave the config untouched: %v", c.ToHierarchicalMap())
+	}
+	if len(NewConfig().AllSettings()) != 0 {
+		t.Errorf("settings of an empty config should be empty")
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	c := NewConfig(WithRedactedKeys("*.Password", "secrets"))
+	c.AddSource(NewBufSource([]byte(`{
+		"db": {"host": "localhost", "password": "hunter2", "replica": {"password": "hunter3"}},
+		"secrets": {"token": "t0k3n"},
+		"secretsx": 1,
+		"api": {"key": "k3y", "keys": ["a"]},
+		"aws": {"credentials": {"id": "x"}}
+	}`), "json"))
+	fm := c.Redacted("api.key", "*.credentials")
+	expected := map[string]interface{}{
+		"db.host":             "localhost",
+		"db.password":         "****",
+		"db.replica.password": "****",
+		"secrets.token":       "****",
+		"secretsx":            1.0,
+		"api.key":             "****",
+		"api.keys":            []interface{}{"a"},
+		"aws.credentials.id":  "****",
+	}
+	if !reflect.DeepEqual(fm, expected) {
+		t.Errorf("unexpected redacted map: %v", fm)
+	}
+	if c.ToFlatMap()["db.password"] != "hunter2" {
+		t.Errorf("redaction should leave the config untouched")
+	}
+	if s := fmt.Sprintf("%v", c); strings.Contains(s, "hunter2") {
+		t.Errorf("string should not include secrets: %s", s)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	schema := []byte(`{
+		"type": "object",
+		"required": ["server", "db"],
+		"properties": {
+			"server": {
+				"type": "object",
+				"required": ["host"],
+				"properties": {
+					"host": {"type": "string"},
+					"port": {"type": "integer", "minimum": 1, "maximum": 65535}
+				}
+			},
+			"debug": {"type": "boolean"}
+		}
+	}`)
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"server": {"port": 70000}, "debug": "yes"}`), "json"))
+	err := c.Validate(schema)
+	if err == nil {
+		t.Fatalf("invalid config should fail")
+	}
+	for _, violation := range []string{"/: missing properties: 'db'", "/server: missing properties: 'host'", "/server/port: must be <= 65535", "/debug: expected boolean"} {
+		if !strings.Contains(err.Error(), violation) {
+			t.Errorf("error should report %q: %s", violation, err)
+		}
+	}
+	c = NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"server": {"host": "localhost"}, "db": {"host": "db"}}`), "json"))
+	c.Set("server.port", 8080)
+	if err := c.Validate(schema); err != nil {
+		t.Errorf("valid config should pass: %s", err)
+	}
+	if err := c.Validate([]byte(`{"type": 1}`)); err == nil || !strings.Contains(err.Error(), "cannot compile schema") {
+		t.Errorf("invalid schema should fail: %v", err)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	c := NewConfig()
+	c.SetDefault("log.level", "info")
+	c.AddSource(NewBufSource([]byte(`{"database": {"host": "localhost"}, "debug": null}`), "json"))
+	if err := c.Require("database.host", "Log.Level", "debug", "database."); err != nil {
+		t.Errorf("set keys should pass: %s", err)
+	}
+	err := c.Require("database.port", "database", "server.", "log.level", "api.key")
+	if err == nil || err.Error() != "missing keys: database.port, database, server., api.key" {
+		t.Errorf("every missing key should be reported: %v", err)
+	}
+}
+
+func TestClone(t *testing.T) {
+	c := NewConfig(WithSeparator("/"))
+	c.SetDefault("log/level", "info")
+	c.AddNamedSource("base", NewBufSource([]byte(`{"hosts": ["a", "b"], "db": {"replicas": [{"host": "r1"}]}}`), "json"))
+	clone := c.Clone()
+	hosts, _ := clone.Get("hosts")
+	hosts.([]interface{})[0] = "x"
+	replicas, _ := clone.Get("db/replicas")
+	replicas.([]interface{})[0].(map[string]interface{})["host"] = "x"
+	clone.Set("port", 80)
+	clone.SetDefault("log/level", "debug")
+	if err := clone.ReplaceSource("base", NewBufSource([]byte(`{"hosts": ["c"]}`), "json")); err != nil {
+		t.Fatalf("clone should keep the source names: %s", err)
+	}
+	expected := map[string]interface{}{
+		"hosts":       []interface{}{"a", "b"},
+		"db/replicas": []interface{}{map[string]interface{}{"host": "r1"}},
+		"log/level":   "info",
+	}
+	if !reflect.DeepEqual(c.ToFlatMap(), expected) {
+		t.Errorf("modifying the clone should leave the config untouched: %v", c.ToFlatMap())
+	}
+	if fmt.Sprint(clone.ToFlatMap()) != "map[hosts:[c] log/level:debug port:80]" {
+		t.Errorf("unexpected clone: %v", clone.ToFlatMap())
+	}
+}
+
+func TestCloneDecodeHooks(t *testing.T) {
+	hook := func(name string) mapstructure.DecodeHookFunc {
+		return func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+			if data == "who" {
+				return name, nil
+			}
+			return data, nil
+		}
+	}
+	c := NewConfig()
+	c.AddSource(NewBufSource([]byte(`{"who": "who"}`), "json"))
+	for i := 0; i < 3; i++ {
+		c.AddDecodeHook(hook("who"))
+	}
+	clone := c.Clone()
+	sub := c.Sub("")
+	clone.AddDecodeHook(hook("clone"))
+	sub.AddDecodeHook(hook("sub"))
+	c.AddDecodeHook(hook("orig"))
+	for _, tc := range []struct {
+		c        *Config
+		expected string
+	}{{c, "orig"}, {clone, "clone"}, {sub, "sub"}} {
+		var v struct{ Who string }
+		if err := tc.c.Unmarshal("", &v); err != nil || v.Who != tc.expected {
+			t.Errorf("expected the %s hook, got: %s, %v", tc.expected, v.Who, err)
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	base := NewConfig()
+	base.SetDefault("log.level", "info")
+	base.AddSource(NewBufSource([]byte(`{"hosts": ["a", "b"], "db": {"port": 5432, "opts": {"ssl": true}}, "debug": false}`), "yaml"))
+	merged := base.Clone()
+	merged.Rebuild(NewBufSource([]byte(`{"hosts": ["a", "c"], "db": {"port": 5432, "user": "app", "opts": {"ssl": true}}}`), "yaml"))
+	added, removed, changed := base.Diff(merged)
+	if fmt.Sprint(added) != "map[db.user:app]" {
+		t.Errorf("unexpected added keys: %v", added)
+	}
+	if fmt.Sprint(removed) != "map[debug:false]" {
+		t.Errorf("unexpected removed keys: %v", removed)
+	}
+	if fmt.Sprint(changed) != "map[hosts:[a c]]" {
+		t.Errorf("unexpected changed keys: %v", changed)
+	}
+	added, removed, changed = base.Diff(base.Clone())
+	if len(added)+len(removed)+len(changed) != 0 {
+		t.Errorf("equal configs should have no difference: %v %v %v", added, removed, changed)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gonfic")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(path, []byte(`{"db": {"host": "localhost", "port": 5432}, "debug": false}`), 0644)
+	os.Setenv("GONFIC_DB_PORT", "5433")
+	defer os.Unsetenv("GONFIC_DB_PORT")
+	c := NewConfig()
+	c.SetDefault("log.level", "info")
+	c.SetDefault("debug", true)
+	c.AddSource(NewFileSource(path))
+	c.AddSource(NewEnvSourceWithPrefix("GONFIC"))
+	c.Set("db.host", "db.example.com")
+	for key, expected := range map[string]string{
+		"db.host":   "set",
+		"DB.PORT":   "env:GONFIC",
+		"debug":     "file:" + path,
+		"log.level": "default",
+	} {
+		if origin, ok := c.Origin(key); !ok || origin != expected {
+			t.Errorf("unexpected origin of %s: %s", key, origin)
+		}
+	}
+	if _, ok := c.Origin("db.user"); ok {
+		t.Errorf("unset key should have no origin")
+	}
+}
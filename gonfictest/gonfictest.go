@@ -0,0 +1,74 @@
+// Package gonfictest provides utilities for tests building gonfic configs.
+package gonfictest
+
+import (
+	"github.com/mitchellh/mapstructure"
+	"github.com/pierredavidbelanger/gonfic"
+	"reflect"
+	"strings"
+)
+
+// TB is the part of testing.TB the helpers use, so they take a *testing.T,
+// a *testing.B, or any other implementation, like a fake in a test.
+type TB interface {
+	Helper()
+	Errorf(format string, args ...interface{})
+	Fatalf(format string, args ...interface{})
+}
+
+// MustConfigFromJSON returns a config loaded from the JSON document js,
+// failing the test if it cannot be loaded.
+func MustConfigFromJSON(t TB, js string) *gonfic.Config {
+	t.Helper()
+	c := gonfic.NewConfig()
+	if err := c.AddSource(gonfic.NewBufSource([]byte(js), "json")); err != nil {
+		t.Fatalf("cannot load config from json: %s", err)
+	}
+	return c
+}
+
+// MustConfigFromMap returns a config loaded from the hierarchical map m,
+// keeping its values as they are, failing the test if it cannot be loaded.
+func MustConfigFromMap(t TB, m map[string]interface{}) *gonfic.Config {
+	t.Helper()
+	fm := make(map[string]interface{})
+	flatten(fm, "", m)
+	c := gonfic.NewConfig()
+	if err := c.MergeFlatMap(fm); err != nil {
+		t.Fatalf("cannot load config from map: %s", err)
+	}
+	return c
+}
+
+func flatten(fm map[string]interface{}, prefix string, m map[string]interface{}) {
+	for key, value := range m {
+		key = prefix + strings.ToLower(key)
+		if sub, ok := value.(map[string]interface{}); ok {
+			flatten(fm, key+".", sub)
+			continue
+		}
+		fm[key] = value
+	}
+}
+
+// AssertKey fails the test if key is not set in c, or if its value,
+// weakly decoded unto the type of want (so 8080.0 from JSON is 8080),
+// is not equal to want.
+func AssertKey(t TB, c *gonfic.Config, key string, want interface{}) {
+	t.Helper()
+	value, ok := c.Get(key)
+	if !ok {
+		t.Errorf("%s is not set, want %v", key, want)
+		return
+	}
+	if want == nil || value == nil {
+		if want != value {
+			t.Errorf("%s is %v, want %v", key, value, want)
+		}
+		return
+	}
+	got := reflect.New(reflect.TypeOf(want))
+	if err := mapstructure.WeakDecode(value, got.Interface()); err != nil || !reflect.DeepEqual(got.Elem().Interface(), want) {
+		t.Errorf("%s is %#v, want %#v", key, value, want)
+	}
+}
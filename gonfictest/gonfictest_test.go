@@ -0,0 +1,43 @@
+package gonfictest
+
+import (
+	"fmt"
+	"testing"
+)
+
+// recorder is a TB recording the failures.
+type recorder struct {
+	errors []string
+	fatals []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func (r *recorder) Fatalf(format string, args ...interface{}) {
+	r.fatals = append(r.fatals, fmt.Sprintf(format, args...))
+}
+
+func TestMustConfig(t *testing.T) {
+	c := MustConfigFromJSON(t, `{"server": {"port": 8080, "hosts": ["a", "b"]}}`)
+	AssertKey(t, c, "server.port", 8080)
+	AssertKey(t, c, "server.hosts", []string{"a", "b"})
+	c = MustConfigFromMap(t, map[string]interface{}{"DB": map[string]interface{}{"name": "test"}, "debug": true})
+	AssertKey(t, c, "db.name", "test")
+	AssertKey(t, c, "debug", true)
+	r := &recorder{}
+	AssertKey(r, c, "db.name", "prod")
+	AssertKey(r, c, "missing", "x")
+	AssertKey(r, c, "debug", true)
+	if fmt.Sprint(r.errors) != `[db.name is "test", want "prod" missing is not set, want x]` {
+		t.Errorf("wrong values should fail the test: %v", r.errors)
+	}
+	r = &recorder{}
+	MustConfigFromJSON(r, `{"server": `)
+	if len(r.fatals) != 1 {
+		t.Errorf("invalid json should stop the test: %v", r.fatals)
+	}
+}
@@ -0,0 +1,100 @@
+package gonfic
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ToHCL returns the keys and values in the config as an HCL document,
+// for example a Terraform variables file: maps become blocks,
+// other values become attributes, and lists become tuples.
+// Attributes come before blocks, each in sorted key order, so the output is stable.
+func (c *Config) ToHCL() ([]byte, error) {
+	return writeHcl(c.ToHierarchicalMap())
+}
+
+var hclIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+func writeHcl(v interface{}) ([]byte, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot write %T as hcl", v)
+	}
+	var b bytes.Buffer
+	if err := writeHclBody(&b, m, ""); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func writeHclBody(b *bytes.Buffer, m map[string]interface{}, indent string) error {
+	var attrs, blocks []string
+	for key, value := range m {
+		if !hclIdentifier.MatchString(key) {
+			return fmt.Errorf("cannot write %q as an hcl identifier", key)
+		}
+		if _, ok := value.(map[string]interface{}); ok {
+			blocks = append(blocks, key)
+		} else {
+			attrs = append(attrs, key)
+		}
+	}
+	sort.Strings(attrs)
+	sort.Strings(blocks)
+	for _, key := range attrs {
+		b.WriteString(indent + key + " = ")
+		writeHclValue(b, m[key], indent)
+		b.WriteByte('\n')
+	}
+	for _, key := range blocks {
+		b.WriteString(indent + key + " {\n")
+		if err := writeHclBody(b, m[key].(map[string]interface{}), indent+"  "); err != nil {
+			return err
+		}
+		b.WriteString(indent + "}\n")
+	}
+	return nil
+}
+
+func writeHclValue(b *bytes.Buffer, value interface{}, indent string) {
+	switch value := value.(type) {
+	case nil:
+		b.WriteString("null")
+	case bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+		fmt.Fprint(b, value)
+	case []interface{}:
+		b.WriteByte('[')
+		for i, elem := range value {
+			if i > 0 {
+				b.WriteString(", ")
+			}
+			writeHclValue(b, elem, indent)
+		}
+		b.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(value))
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		b.WriteString("{\n")
+		for _, key := range keys {
+			b.WriteString(indent + "  " + hclString(key) + " = ")
+			writeHclValue(b, value[key], indent+"  ")
+			b.WriteByte('\n')
+		}
+		b.WriteString(indent + "}")
+	default:
+		b.WriteString(hclString(fmt.Sprint(value)))
+	}
+}
+
+var hclEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "${", "$${", "%{", "%%{")
+
+// hclString quotes s as an HCL string, escaping template sequences.
+func hclString(s string) string {
+	return `"` + hclEscaper.Replace(s) + `"`
+}
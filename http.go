@@ -0,0 +1,122 @@
+package gonfic
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+type httpSource struct {
+	url    string
+	client *http.Client
+	opts   sourceOptions
+}
+
+// HTTPOption alters the way the http source fetches its content.
+type HTTPOption func(*httpSource)
+
+// contentTypes maps the media types an http source understands to their extension.
+var contentTypes = map[string]string{
+	"application/json":   "json",
+	"text/json":          "json",
+	"application/yaml":   "yaml",
+	"application/x-yaml": "yaml",
+	"text/yaml":          "yaml",
+	"text/x-yaml":        "yaml",
+	"application/toml":   "toml",
+	"application/cbor":   "cbor",
+}
+
+// NewHTTPSource returns a source that GETs url and parses the response body
+// according to its Content-Type header or, if that is not a known config
+// media type, according to the extension of the url path.
+// A response with a non 2xx status is an error (ErrNotFound for a 404).
+func NewHTTPSource(url string, opts ...HTTPOption) Source {
+	s := &httpSource{url: url, client: http.DefaultClient, opts: newSourceOptions(nil)}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// WithHTTPClient makes the http source use client, to set its timeouts or TLS config.
+func WithHTTPClient(client *http.Client) HTTPOption {
+	return func(s *httpSource) {
+		s.client = client
+	}
+}
+
+// WithHTTPSourceOptions applies opts, like WithMaxBytes or WithTimeout, to the http source.
+func WithHTTPSourceOptions(opts ...SourceOption) HTTPOption {
+	return func(s *httpSource) {
+		for _, opt := range opts {
+			opt(&s.opts)
+		}
+	}
+}
+
+func (s *httpSource) String() string {
+	return "http:" + s.url
+}
+
+func (s *httpSource) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return s.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, but the request is canceled when ctx is done.
+func (s *httpSource) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	buf, ext, err := s.fetch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("cannot get %s: %w", s.url, err)
+	}
+	bufSource := &bufSource{buf: buf, ext: ext, opts: s.opts}
+	config, err = bufSource.OverrideContext(ctx, config)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", s.url, err)
+	}
+	return config, nil
+}
+
+func (s *httpSource) fetch(ctx context.Context) ([]byte, string, error) {
+	ctx, cancel := s.opts.context(ctx)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, s.url, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	res, err := s.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		err = fmt.Errorf("unexpected status %s", res.Status)
+		if res.StatusCode == http.StatusNotFound {
+			err = &Error{Kind: ErrNotFound, Err: err}
+		}
+		return nil, "", err
+	}
+	buf, err := readAllLimited(res.Body, s.opts.maxBytes)
+	if err != nil {
+		return nil, "", err
+	}
+	return buf, s.ext(res.Header.Get("Content-Type")), nil
+}
+
+// ext returns the extension of the content type, or of the url path.
+func (s *httpSource) ext(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		if ext, ok := contentTypes[mediaType]; ok {
+			return ext
+		}
+	}
+	p := s.url
+	if u, err := url.Parse(s.url); err == nil {
+		p = u.Path
+	}
+	return strings.ToLower(strings.TrimPrefix(path.Ext(p), "."))
+}
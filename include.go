@@ -0,0 +1,155 @@
+package gonfic
+
+import (
+	"bytes"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"path/filepath"
+	"strings"
+)
+
+const includeKey = "$include"
+
+// WithIncludes makes a source resolve include directives before loading its content.
+// A map holding an "$include" key is replaced by the content of the file
+// at that path, with the other keys of the map merged over it.
+// In YAML, a "!include path" value is a shorthand for {"$include": "path"}.
+// Relative paths are resolved from the directory of the including file,
+// or from the working directory when there is no such file.
+// An include cycle is an error.
+func WithIncludes() SourceOption {
+	return func(o *sourceOptions) {
+		o.includes = true
+	}
+}
+
+func readBufWithIncludes(buf []byte, ext string, path string, maxBytes int64, sep string) (map[string]interface{}, error) {
+	dir := ""
+	var stack []string
+	if path != "" {
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Dir(abs)
+		stack = []string{abs}
+	}
+	m, err := parseIncludingBuf(buf, ext)
+	if err != nil {
+		return nil, err
+	}
+	m, err = resolveIncludes(m, dir, stack, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	return flatten(m, joiner(sep)), nil
+}
+
+// parseIncludingBuf is parseBuf, with YAML !include tags rewritten as $include maps.
+func parseIncludingBuf(buf []byte, ext string) (map[string]interface{}, error) {
+	if (ext == "yaml" || ext == "yml") && bytes.Contains(buf, []byte("!include")) {
+		var doc yaml.Node
+		if err := yaml.Unmarshal(buf, &doc); err != nil {
+			return nil, &Error{Kind: ErrParse, Err: fmt.Errorf("cannot parse %s buf: %w", ext, err)}
+		}
+		if rewriteIncludes(&doc) {
+			rewritten, err := yaml.Marshal(&doc)
+			if err != nil {
+				return nil, err
+			}
+			buf = rewritten
+		}
+	}
+	return parseBuf(buf, ext)
+}
+
+// rewriteIncludes replaces each "!include path" scalar of the tree of node
+// by a {"$include": "path"} map, and returns whether there was any.
+// Being tags, and not text, they are never found in strings or comments.
+func rewriteIncludes(node *yaml.Node) bool {
+	if node.Kind == yaml.ScalarNode && node.Tag == "!include" {
+		*node = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: includeKey},
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: node.Value},
+		}}
+		return true
+	}
+	found := false
+	for _, child := range node.Content {
+		if rewriteIncludes(child) {
+			found = true
+		}
+	}
+	return found
+}
+
+func resolveIncludes(m map[string]interface{}, dir string, stack []string, maxBytes int64) (map[string]interface{}, error) {
+	res := make(map[string]interface{})
+	if include, ok := m[includeKey]; ok {
+		target, ok := include.(string)
+		if !ok {
+			return nil, fmt.Errorf("%s must be a path, got %v", includeKey, include)
+		}
+		included, err := loadInclude(target, dir, stack, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		res = included
+	}
+	for key, value := range m {
+		if key == includeKey {
+			continue
+		}
+		value, err := resolveIncludesValue(value, dir, stack, maxBytes)
+		if err != nil {
+			return nil, err
+		}
+		res[key] = value
+	}
+	return res, nil
+}
+
+func resolveIncludesValue(value interface{}, dir string, stack []string, maxBytes int64) (interface{}, error) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		return resolveIncludes(value, dir, stack, maxBytes)
+	case []interface{}:
+		res := make([]interface{}, len(value))
+		for i, elem := range value {
+			elem, err := resolveIncludesValue(elem, dir, stack, maxBytes)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = elem
+		}
+		return res, nil
+	}
+	return value, nil
+}
+
+func loadInclude(target string, dir string, stack []string, maxBytes int64) (map[string]interface{}, error) {
+	path := target
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	stack = append(stack[:len(stack):len(stack)], path)
+	for _, p := range stack[:len(stack)-1] {
+		if p == path {
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(stack, " -> "))
+		}
+	}
+	buf, err := readFileLimited(path, maxBytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot include %s: %w", target, err)
+	}
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
+	m, err := parseIncludingBuf(buf, ext)
+	if err != nil {
+		return nil, fmt.Errorf("cannot include %s: %w", target, err)
+	}
+	return resolveIncludes(m, filepath.Dir(path), stack, maxBytes)
+}
@@ -0,0 +1,54 @@
+package gonfic
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// NewIniSource returns a source that loads the INI file at path,
+// whatever its extension (files ending in .ini are also loaded
+// as INI by NewFileSource): key = value (or key: value) lines,
+// under [section] headers, with ; or # comment lines.
+// The keys of a section are under the section name (section.key),
+// and the keys before the first section, the global ones, are at the top level.
+// A section repeated later in the file adds to the first one.
+// Values are always strings, without their surrounding quotes if any.
+func NewIniSource(path string, opts ...SourceOption) Source {
+	return &fileSource{path: path, ext: "ini", opts: newSourceOptions(opts)}
+}
+
+// readIni reads an INI file, as described by NewIniSource, into a flat map,
+// so a global key can also be a section, like a = 1 and [a] b = 2.
+func readIni(buf []byte) (map[string]interface{}, error) {
+	flat := make(map[string]interface{})
+	prefix := ""
+	scanner := bufio.NewScanner(bytes.NewReader(buf))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated section", n)
+			}
+			prefix = strings.TrimSpace(line[1:len(line)-1]) + "."
+			continue
+		}
+		i := strings.IndexAny(line, "=:")
+		if i <= 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		flat[prefix+key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return flat, nil
+}
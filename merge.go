@@ -0,0 +1,107 @@
+package gonfic
+
+import (
+	"reflect"
+	"strings"
+)
+
+// MergeStrategy is the way a list set by a source is merged
+// with the list a previous source set for the same key.
+type MergeStrategy int
+
+const (
+	// MergeReplace keeps only the new list (the default).
+	MergeReplace MergeStrategy = iota
+	// MergeAppend appends the new list to the previous one.
+	MergeAppend
+	// MergeUnion appends the elements of the new list that are not already in the previous one.
+	MergeUnion
+)
+
+// WithMergeStrategy sets the strategy used for the lists of every key,
+// unless WithKeyMergeStrategy sets another one for the key.
+// Strategies apply to keys whose whole value is a list; a source that
+// sets the exact same list as before leaves it unchanged. Indexed keys,
+// like servers.1.host, are not merged: they override the element
+// of the list once merged.
+func WithMergeStrategy(s MergeStrategy) Option {
+	return func(c *Config) {
+		c.mergeStrategy = s
+	}
+}
+
+// WithKeyMergeStrategy sets the strategy used for the lists of key,
+// for additive lists like plugins or middlewares.
+func WithKeyMergeStrategy(key string, s MergeStrategy) Option {
+	return func(c *Config) {
+		if c.keyStrategies == nil {
+			c.keyStrategies = make(map[string]MergeStrategy)
+		}
+		c.keyStrategies[strings.ToLower(key)] = s
+	}
+}
+
+func (c *Config) strategy(key string) MergeStrategy {
+	if s, ok := c.keyStrategies[key]; ok {
+		return s
+	}
+	return c.mergeStrategy
+}
+
+// mergeLists merges, in applied, the lists a source changed
+// with their previous value in flat, according to their strategy.
+func (c *Config) mergeLists(flat map[string]interface{}, applied map[string]interface{}) {
+	if c.mergeStrategy == MergeReplace && len(c.keyStrategies) == 0 {
+		return
+	}
+	for key, value := range applied {
+		s := c.strategy(key)
+		if s == MergeReplace {
+			continue
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			continue
+		}
+		old, ok := flat[key].([]interface{})
+		if !ok || reflect.DeepEqual(old, list) {
+			continue
+		}
+		merged := append([]interface{}(nil), old...)
+		for _, elem := range list {
+			if s == MergeUnion && containsValue(merged, elem) {
+				continue
+			}
+			merged = append(merged, elem)
+		}
+		applied[key] = merged
+	}
+}
+
+func containsValue(list []interface{}, value interface{}) bool {
+	for _, elem := range list {
+		if reflect.DeepEqual(elem, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropStaleElements removes from applied the indexed keys (like servers.1.host)
+// set by previous sources under a list that the source changed, since
+// the new list replaces the elements they were overriding.
+func dropStaleElements(flat map[string]interface{}, applied map[string]interface{}, sep string) {
+	for key, value := range applied {
+		if _, ok := value.([]interface{}); !ok || reflect.DeepEqual(flat[key], value) {
+			continue
+		}
+		for subkey, subvalue := range applied {
+			if !strings.HasPrefix(subkey, key+sep) {
+				continue
+			}
+			if old, ok := flat[subkey]; ok && reflect.DeepEqual(old, subvalue) {
+				delete(applied, subkey)
+			}
+		}
+	}
+}
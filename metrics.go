@@ -0,0 +1,41 @@
+package gonfic
+
+import "time"
+
+// Metrics receives measures of the config loads (AddSource, Rebuild,
+// ReplaceSource, LoadAtomic and the like), to be exported to a metrics
+// system, for example as Prometheus config_reload_total and
+// config_reload_errors_total counters, and config_keys and
+// config_last_reload_timestamp_seconds gauges.
+type Metrics interface {
+	// IncReloads is called on every load, successful or not.
+	IncReloads()
+	// IncReloadErrors is called on every failed load.
+	IncReloadErrors()
+	// SetKeys is called after a successful load with the number of keys in the config.
+	SetKeys(n int)
+	// SetLastReload is called after a successful load with the time it ended.
+	SetLastReload(t time.Time)
+}
+
+// WithMetrics makes the config report its loads to m.
+func WithMetrics(m Metrics) Option {
+	return func(c *Config) {
+		c.metrics = m
+	}
+}
+
+// measure reports a load that failed with err, or succeeded if err is nil, and returns err.
+func (c *Config) measure(err error) error {
+	if c.metrics == nil {
+		return err
+	}
+	c.metrics.IncReloads()
+	if err != nil {
+		c.metrics.IncReloadErrors()
+		return err
+	}
+	c.metrics.SetKeys(c.Len())
+	c.metrics.SetLastReload(time.Now())
+	return nil
+}
@@ -0,0 +1,61 @@
+package gonfic
+
+import (
+	"reflect"
+	"sort"
+	"time"
+)
+
+// SourceEvent describes the outcome of applying a source to the config.
+type SourceEvent struct {
+	// Source is the name of the source, like "file:config.yaml".
+	Source string
+	// Added holds the keys that the source set for the first time, sorted.
+	Added []string
+	// Overridden holds the keys that the source changed the value of, sorted.
+	Overridden []string
+	// Duration is how long the source took to load.
+	Duration time.Duration
+	// Err is the reason the source failed, if it did,
+	// in which case Added and Overridden are empty.
+	Err error
+}
+
+// WithObserver makes AddSource (and Rebuild) call fn after each source is applied,
+// successfully or not, to log or measure the config loading.
+func WithObserver(fn func(SourceEvent)) Option {
+	return func(c *Config) {
+		c.observer = fn
+	}
+}
+
+func (c *Config) observe(span Span, s Source, before, after map[string]interface{}, d time.Duration, err error) {
+	if c.observer == nil && span == nil {
+		return
+	}
+	e := SourceEvent{Source: sourceName(s), Duration: d, Err: err}
+	if err == nil {
+		for key, value := range after {
+			old, ok := before[key]
+			if !ok {
+				e.Added = append(e.Added, key)
+			} else if !reflect.DeepEqual(old, value) {
+				e.Overridden = append(e.Overridden, key)
+			}
+		}
+		sort.Strings(e.Added)
+		sort.Strings(e.Overridden)
+	}
+	if span != nil {
+		span.SetAttribute("gonfic.source", e.Source)
+		span.SetAttribute("gonfic.keys.added", len(e.Added))
+		span.SetAttribute("gonfic.keys.overridden", len(e.Overridden))
+		if err != nil {
+			span.RecordError(err)
+		}
+		span.End()
+	}
+	if c.observer != nil {
+		c.observer(e)
+	}
+}
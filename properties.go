@@ -0,0 +1,199 @@
+package gonfic
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// ToProperties returns the keys and values in the config as
+// a Java .properties document, one key=value line per key, in sorted key order.
+// List and map values are written as JSON.
+func (c *Config) ToProperties() ([]byte, error) {
+	return writeProperties(c.ToFlatMap())
+}
+
+func marshalProperties(v interface{}) ([]byte, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("cannot write %T as properties", v)
+	}
+	return writeProperties(flatten(m, dotJoiner))
+}
+
+func writeProperties(fm map[string]interface{}) ([]byte, error) {
+	keys := make([]string, 0, len(fm))
+	for key := range fm {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var b bytes.Buffer
+	for _, key := range keys {
+		value, err := scalarString(fm[key])
+		if err != nil {
+			return nil, fmt.Errorf("cannot write %s: %w", key, err)
+		}
+		b.WriteString(escapeProperty(key, true))
+		b.WriteByte('=')
+		b.WriteString(escapeProperty(value, false))
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+// scalarString formats value as a string, using JSON for lists and maps.
+func scalarString(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case []interface{}, map[string]interface{}:
+		buf, err := json.Marshal(value)
+		return string(buf), err
+	}
+	return fmt.Sprint(value), nil
+}
+
+// escapeProperty escapes s as a .properties key or value.
+func escapeProperty(s string, key bool) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case r == '\f':
+			b.WriteString(`\f`)
+		case r == ' ' && (key || i == 0):
+			b.WriteString(`\ `)
+		case (r == '=' || r == ':') && key, (r == '#' || r == '!') && i == 0:
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r < 0x20 || r > 0x7e:
+			for _, u := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&b, `\u%04x`, u)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// readProperties reads a Java .properties file: key=value, key:value
+// or key value lines, with # or ! comment lines, and lines continued
+// by a trailing backslash. Keys are used as is, so a.b.c=value is a.b.c,
+// and values are strings. It returns a flat map, so a key can be
+// the parent of other keys, like logging.level and logging.level.root.
+func readProperties(buf []byte) (map[string]interface{}, error) {
+	flat := make(map[string]interface{})
+	lines := strings.Split(strings.Replace(string(buf), "\r\n", "\n", -1), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimLeft(lines[i], " \t\f")
+		if line == "" || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+		for continued(line) && i+1 < len(lines) {
+			i++
+			line = line[:len(line)-1] + strings.TrimLeft(lines[i], " \t\f")
+		}
+		key, value, err := splitProperty(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		flat[key] = value
+	}
+	return flat, nil
+}
+
+// continued returns whether line ends with an odd number of backslashes.
+func continued(line string) bool {
+	n := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		n++
+	}
+	return n%2 == 1
+}
+
+// splitProperty splits a logical line into its unescaped key and value.
+func splitProperty(line string) (string, string, error) {
+	end := len(line)
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] == '=' || line[i] == ':' || line[i] == ' ' || line[i] == '\t' || line[i] == '\f' {
+			end = i
+			break
+		}
+	}
+	key, rest := line[:end], strings.TrimLeft(line[end:], " \t\f")
+	if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+	key, err := unescapeProperty(key)
+	if err != nil {
+		return "", "", err
+	}
+	value, err := unescapeProperty(rest)
+	return key, value, err
+}
+
+func unescapeProperty(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+	var b strings.Builder
+	var surrogate rune
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if i+5 > len(s) {
+				return "", fmt.Errorf("malformed \\u escape")
+			}
+			n, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			if err != nil {
+				return "", fmt.Errorf("malformed \\u escape: %w", err)
+			}
+			i += 4
+			r := rune(n)
+			switch {
+			case utf16.IsSurrogate(r) && surrogate == 0:
+				surrogate = r
+				continue
+			case surrogate != 0:
+				r = utf16.DecodeRune(surrogate, r)
+				surrogate = 0
+			}
+			b.WriteRune(r)
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
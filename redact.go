@@ -0,0 +1,64 @@
+package gonfic
+
+import (
+	"path"
+	"strings"
+)
+
+const redaction = "****"
+
+// WithRedactedKeys registers the keys whose values Redacted hides, like
+// passwords and tokens. Each of keys is either a key, like "db.password",
+// a prefix, like "secrets" for every key under it, or a glob, as for path.Match,
+// like "*.password", matched against the key and against each of its prefixes.
+func WithRedactedKeys(keys ...string) Option {
+	return func(c *Config) {
+		for _, key := range keys {
+			c.redactedKeys = append(c.redactedKeys, strings.ToLower(key))
+		}
+	}
+}
+
+// Redacted returns a flat map of the keys and values in the config, like ToFlatMap,
+// but with the value of each key matching one of keys, or of the keys registered
+// with WithRedactedKeys, replaced by "****", so it can safely end up in logs.
+func (c *Config) Redacted(keys ...string) map[string]interface{} {
+	patterns := append([]string(nil), c.redactedKeys...)
+	for _, key := range keys {
+		patterns = append(patterns, strings.ToLower(key))
+	}
+	fm := c.ToFlatMap()
+	for key := range fm {
+		if redacts(patterns, key, c.sep()) {
+			fm[key] = redaction
+		}
+	}
+	return fm
+}
+
+// redacts returns whether key, or one of its prefixes, matches one of patterns.
+func redacts(patterns []string, key string, sep string) bool {
+	for _, pattern := range patterns {
+		if key == pattern || strings.HasPrefix(key, pattern+sep) {
+			return true
+		}
+		if !strings.ContainsAny(pattern, `*?[\`) {
+			continue
+		}
+		for n := 0; ; {
+			prefix := key
+			i := strings.Index(key[n:], sep)
+			if i >= 0 {
+				prefix = key[:n+i]
+			}
+			if ok, _ := path.Match(pattern, prefix); ok {
+				return true
+			}
+			if i < 0 {
+				break
+			}
+			n += i + len(sep)
+		}
+	}
+	return false
+}
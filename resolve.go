@@ -0,0 +1,223 @@
+package gonfic
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ResolveOption alters the way Resolve replaces references.
+type ResolveOption func(*resolver)
+
+// WithUnresolvedLiteral makes Resolve leave a reference to a missing key,
+// or to an unset environment variable, as it is, instead of failing.
+func WithUnresolvedLiteral() ResolveOption {
+	return func(r *resolver) {
+		r.keepMissing = true
+	}
+}
+
+// WithBareEnv makes Resolve also expand $NAME as the environment variable NAME,
+// like a shell; $$ is then a literal $. It is not the default, since a value
+// like a password may well contain a $.
+func WithBareEnv() ResolveOption {
+	return func(r *resolver) {
+		r.bareEnv = true
+	}
+}
+
+// Resolve replaces, in every string value of the config (defaults included),
+// each ${key} reference by the value of key, so log.file can be "${app.home}/app.log".
+// References are resolved transitively; a value that is a single reference
+// takes the value of the key as is (a number stays a number), and $${ is a literal ${.
+// ${ENV:NAME} is replaced by the environment variable NAME: a reference
+// is to an environment variable only with the ENV: prefix, and to a key otherwise.
+// Either can have a default, used when the key or variable is not set,
+// like ${ENV:PORT:-8080} or ${app.home:-/opt/app}.
+// A reference cycle is an error, and so is a reference to a missing key,
+// unless WithUnresolvedLiteral is given. If any value fails, the config is left untouched.
+// The resolution is recorded as a source named "resolve", that sets the
+// resolved values, and is applied again when the sources are, for example
+// by ReplaceSource, Rebuild or a Watch reload.
+func (c *Config) Resolve(opts ...ResolveOption) error {
+	return c.step(&stepSource{name: "resolve", fn: func(c *Config, config map[string]interface{}) (map[string]interface{}, error) {
+		return c.resolve(config, opts)
+	}})
+}
+
+// resolve sets in config, the flat map of the sources, the values
+// that Resolve changes, those of the defaults included.
+func (c *Config) resolve(config map[string]interface{}, opts []ResolveOption) (map[string]interface{}, error) {
+	fm := copyFlatMap(c.defaults)
+	for key, value := range config {
+		fm[key] = value
+	}
+	r := &resolver{fm: fm, resolved: make(map[string]interface{})}
+	for _, opt := range opts {
+		opt(r)
+	}
+	keys := make([]string, 0, len(r.fm))
+	for key := range r.fm {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if _, err := r.value(key); err != nil {
+			return nil, fmt.Errorf("cannot resolve %s: %w", key, err)
+		}
+	}
+	for key, value := range r.resolved {
+		if !reflect.DeepEqual(value, fm[key]) {
+			config[key] = value
+		}
+	}
+	return config, nil
+}
+
+type resolver struct {
+	fm          map[string]interface{}
+	resolved    map[string]interface{}
+	stack       []string
+	keepMissing bool
+	bareEnv     bool
+}
+
+// value returns the resolved value of key, which must be set.
+func (r *resolver) value(key string) (interface{}, error) {
+	if value, ok := r.resolved[key]; ok {
+		return value, nil
+	}
+	for i, k := range r.stack {
+		if k == key {
+			return nil, fmt.Errorf("interpolation cycle: %s", strings.Join(append(r.stack[i:], key), " -> "))
+		}
+	}
+	value := r.fm[key]
+	if s, ok := value.(string); ok && (strings.Contains(s, "${") || r.bareEnv && strings.Contains(s, "$")) {
+		r.stack = append(r.stack, key)
+		expanded, err := r.expand(s)
+		r.stack = r.stack[:len(r.stack)-1]
+		if err != nil {
+			return nil, err
+		}
+		value = expanded
+	}
+	r.resolved[key] = value
+	return value, nil
+}
+
+// expand returns s with its references replaced.
+func (r *resolver) expand(s string) (interface{}, error) {
+	if strings.HasPrefix(s, "${") && strings.Index(s, "}") == len(s)-1 {
+		value, ok, err := r.reference(s[2 : len(s)-1])
+		if err != nil || ok {
+			return value, err
+		}
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+		var token string
+		var value interface{}
+		var ok bool
+		var err error
+		switch n := envNameLen(s[1:]); {
+		case strings.HasPrefix(s, "$${"):
+			b.WriteString("${")
+			s = s[3:]
+			continue
+		case r.bareEnv && strings.HasPrefix(s, "$$"):
+			b.WriteString("$")
+			s = s[2:]
+			continue
+		case strings.HasPrefix(s, "${"):
+			end := strings.IndexByte(s, '}')
+			if end < 0 {
+				b.WriteString(s)
+				return b.String(), nil
+			}
+			token = s[:end+1]
+			value, ok, err = r.reference(token[2:end])
+		case r.bareEnv && n > 0:
+			token = s[:1+n]
+			value, ok, err = r.env(s[1:1+n], "", false)
+		default:
+			b.WriteString("$")
+			s = s[1:]
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s = s[len(token):]
+		if !ok {
+			b.WriteString(token)
+			continue
+		}
+		str, err := scalarString(value)
+		if err != nil {
+			str = fmt.Sprint(value)
+		}
+		b.WriteString(str)
+	}
+}
+
+// envNameLen returns the length of the environment variable name s starts with.
+func envNameLen(s string) int {
+	for i, r := range s {
+		if r != '_' && (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (i == 0 || r < '0' || r > '9') {
+			return i
+		}
+	}
+	return len(s)
+}
+
+// reference returns the resolved value of the key, or of the environment
+// variable, referenced by ref, and false if it is missing and must be left as is.
+func (r *resolver) reference(ref string) (interface{}, bool, error) {
+	def, hasDef := "", false
+	if i := strings.Index(ref, ":-"); i >= 0 {
+		ref, def, hasDef = ref[:i], ref[i+2:], true
+	}
+	if strings.HasPrefix(ref, "ENV:") {
+		return r.env(strings.TrimPrefix(ref, "ENV:"), def, hasDef)
+	}
+	key := ref
+	if _, ok := r.fm[key]; !ok {
+		key = strings.ToLower(key)
+	}
+	if _, ok := r.fm[key]; !ok {
+		if hasDef {
+			return def, true, nil
+		}
+		if r.keepMissing {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("no key %s", ref)
+	}
+	value, err := r.value(key)
+	return value, true, err
+}
+
+// env returns the value of the environment variable name, or def if it is not set and hasDef.
+func (r *resolver) env(name string, def string, hasDef bool) (interface{}, bool, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+	if hasDef {
+		return def, true, nil
+	}
+	if r.keepMissing {
+		return nil, false, nil
+	}
+	return nil, false, fmt.Errorf("environment variable %s is not set", name)
+}
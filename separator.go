@@ -0,0 +1,96 @@
+package gonfic
+
+import (
+	"context"
+	"strings"
+)
+
+// DefaultSeparator separates the components of keys, unless changed with WithSeparator.
+const DefaultSeparator = "."
+
+// WithSeparator sets the separator of the key components (defaults to "."),
+// for configs whose keys contain dots, like host names or versions:
+// with "/", hosts: {example.com: {port: 80}} is the key hosts/example.com/port.
+// Every key given to or returned by the config uses it, as well as the keys
+// built by the sources of this package (env variables are split on it too);
+// custom sources get it with SeparatorFromContext when they implement ContextSource.
+func WithSeparator(sep string) Option {
+	return func(c *Config) {
+		c.separator = sep
+	}
+}
+
+// sep returns the separator of the config keys.
+func (c *Config) sep() string {
+	if c.separator == "" {
+		return DefaultSeparator
+	}
+	return c.separator
+}
+
+type separatorKey struct{}
+
+// contextWithSeparator returns a child of ctx carrying sep, for the sources.
+func contextWithSeparator(ctx context.Context, sep string) context.Context {
+	return context.WithValue(ctx, separatorKey{}, sep)
+}
+
+// SeparatorFromContext returns the separator of the keys of the config
+// loading a ContextSource, or DefaultSeparator if there is none.
+func SeparatorFromContext(ctx context.Context) string {
+	if sep, ok := ctx.Value(separatorKey{}).(string); ok && sep != "" {
+		return sep
+	}
+	return DefaultSeparator
+}
+
+// joiner returns the func joining key components with sep.
+// A separator or a backslash in a component is escaped by a backslash,
+// so hosts: {example.com: 80} is the key hosts.example\.com.
+func joiner(sep string) func([]string) string {
+	return func(a []string) string {
+		for i, k := range a {
+			if strings.Contains(k, sep) || strings.Contains(k, `\`) {
+				a = append([]string(nil), a...)
+				for j := i; j < len(a); j++ {
+					a[j] = escapeKey(a[j], sep)
+				}
+				break
+			}
+		}
+		return strings.Join(a, sep)
+	}
+}
+
+func escapeKey(k string, sep string) string {
+	return strings.Replace(strings.Replace(k, `\`, `\\`, -1), sep, `\`+sep, -1)
+}
+
+// slicer returns the func splitting a key into its components separated by sep,
+// unescaping the separators and backslashes escaped by a backslash.
+func slicer(sep string) func(string) []string {
+	return func(s string) []string {
+		if !strings.Contains(s, `\`) {
+			return strings.Split(s, sep)
+		}
+		var keys []string
+		var b strings.Builder
+		for i := 0; i < len(s); i++ {
+			switch {
+			case s[i] == '\\' && i+1 < len(s) && s[i+1] == '\\':
+				b.WriteByte('\\')
+				i++
+			case s[i] == '\\' && strings.HasPrefix(s[i+1:], sep):
+				b.WriteString(sep)
+				i += len(sep)
+			case strings.HasPrefix(s[i:], sep):
+				keys = append(keys, b.String())
+				b.Reset()
+				i += len(sep) - 1
+			default:
+				b.WriteByte(s[i])
+			}
+		}
+		return append(keys, b.String())
+	}
+}
@@ -0,0 +1,114 @@
+package gonfic
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+)
+
+type subscription struct {
+	prefix string
+	fn     func(key string, old, new interface{})
+}
+
+// Subscription is a registered change notification, see Config.Subscribe.
+type Subscription struct {
+	c  *Config
+	id int
+}
+
+// Subscribe registers fn to be called for each key under prefix
+// (or equal to it, or any key if prefix is empty) whose value changes
+// when the config is modified, for example by AddSource, Rebuild or SetDefault.
+// old is nil when the key is added, and new is nil when it is removed.
+// fn is called once the config is unlocked, so it may read the config.
+func (c *Config) Subscribe(prefix string, fn func(key string, old, new interface{})) *Subscription {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[int]*subscription)
+	}
+	c.subscribed++
+	c.subscriptions[c.subscribed] = &subscription{prefix: c.keyPrefix(prefix), fn: fn}
+	return &Subscription{c: c, id: c.subscribed}
+}
+
+// Unsubscribe stops the notifications.
+func (s *Subscription) Unsubscribe() {
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	delete(s.c.subscriptions, s.id)
+}
+
+// change is a modification of the config, not yet notified to the subscribers.
+type change struct {
+	before map[string]interface{}
+	after  map[string]interface{}
+}
+
+// lock locks the config for a modification.
+func (c *Config) lock() {
+	c.mu.Lock()
+}
+
+// unlock unlocks the config, then notifies the subscribers of the changes
+// made while it was locked, so they can read (but not modify) the config.
+func (c *Config) unlock() {
+	changes := c.changes
+	c.changes = nil
+	var subs []*subscription
+	if len(changes) > 0 {
+		ids := make([]int, 0, len(c.subscriptions))
+		for id := range c.subscriptions {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			subs = append(subs, c.subscriptions[id])
+		}
+	}
+	c.mu.Unlock()
+	for _, ch := range changes {
+		c.notify(subs, ch.before, ch.after)
+	}
+}
+
+// update runs fn, which modifies the config, and records the changes for
+// the subscribers. The config must be locked; fn must replace c.flat and
+// c.defaults rather than modify them in place, since readers keep them once unlocked.
+func (c *Config) update(fn func()) {
+	if len(c.subscriptions) == 0 {
+		fn()
+		c.invalidateTree()
+		return
+	}
+	before := c.flatMap()
+	fn()
+	c.invalidateTree()
+	c.changes = append(c.changes, change{before: before, after: c.flatMap()})
+}
+
+func (c *Config) notify(subs []*subscription, before map[string]interface{}, after map[string]interface{}) {
+	var changed []string
+	for key, value := range after {
+		if old, ok := before[key]; !ok || !reflect.DeepEqual(old, value) {
+			changed = append(changed, key)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	sort.Strings(changed)
+	for _, sub := range subs {
+		for _, key := range changed {
+			if sub.prefix == "" || key == sub.prefix || strings.HasPrefix(key, sub.prefix+c.sep()) {
+				sub.fn(key, before[key], after[key])
+			}
+		}
+	}
+}
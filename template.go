@@ -0,0 +1,59 @@
+package gonfic
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// ExpandTemplate runs every string value of the config (defaults included)
+// through text/template with data, replacing the values by the result,
+// for example "https://{{.Host}}:{{.Port}}/api". A missing map key is an error.
+// If any value fails to parse or execute, the config is left untouched.
+// The expansion is recorded as a source named "template", that sets the
+// expanded values, and is applied again with data when the sources are,
+// for example by ReplaceSource, Rebuild or a Watch reload.
+func (c *Config) ExpandTemplate(data interface{}) error {
+	return c.step(&stepSource{name: "template", fn: func(c *Config, config map[string]interface{}) (map[string]interface{}, error) {
+		fm := copyFlatMap(c.defaults)
+		for key, value := range config {
+			fm[key] = value
+		}
+		expanded, err := expandTemplates(fm, data)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range expanded {
+			config[key] = value
+		}
+		return config, nil
+	}})
+}
+
+// expandTemplates returns the expanded values of the keys of fm whose value is a template.
+func expandTemplates(fm map[string]interface{}, data interface{}) (map[string]interface{}, error) {
+	expanded := make(map[string]interface{})
+	keys := make([]string, 0, len(fm))
+	for key := range fm {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s, ok := fm[key].(string)
+		if !ok || !strings.Contains(s, "{{") {
+			continue
+		}
+		t, err := template.New(key).Option("missingkey=error").Parse(s)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse template of %s: %w", key, err)
+		}
+		var b bytes.Buffer
+		if err := t.Execute(&b, data); err != nil {
+			return nil, fmt.Errorf("cannot execute template of %s: %w", key, err)
+		}
+		expanded[key] = b.String()
+	}
+	return expanded, nil
+}
@@ -0,0 +1,57 @@
+package gonfic
+
+import (
+	"context"
+	"strings"
+)
+
+// Tracer starts the spans traced around each source load.
+// It is meant to be implemented on top of a tracing library,
+// like OpenTelemetry, so gonfic does not depend on any.
+type Tracer interface {
+	// Start starts a span named name, child of the span in ctx if any,
+	// and returns a context holding the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	SetAttribute(key string, value interface{})
+	RecordError(err error)
+	End()
+}
+
+// WithTracer makes the config trace a span around each source load,
+// named after the kind of source ("gonfic.file", "gonfic.command", ...),
+// with the source name, and the number of keys it added and overrode, as attributes.
+// The span of a source added with AddSourceContext is a child of the span in its context.
+func WithTracer(t Tracer) Option {
+	return func(c *Config) {
+		c.tracer = t
+	}
+}
+
+// ContextSource is implemented by sources, usually remote ones,
+// that can be cancelled, and traced, through a context.
+type ContextSource interface {
+	Source
+	OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error)
+}
+
+// AddSourceContext is like AddSource, but gives ctx to s if it is a ContextSource,
+// and uses it as the parent of the span traced around s (see WithTracer).
+func (c *Config) AddSourceContext(ctx context.Context, s Source) error {
+	return c.measure(c.addSource(ctx, "", s))
+}
+
+// startSpan starts the span of s, if the config has a tracer.
+func (c *Config) startSpan(ctx context.Context, s Source) (context.Context, Span) {
+	if c.tracer == nil {
+		return ctx, nil
+	}
+	kind := sourceName(s)
+	if i := strings.Index(kind, ":"); i >= 0 {
+		kind = kind[:i]
+	}
+	return c.tracer.Start(ctx, "gonfic."+kind)
+}
@@ -0,0 +1,61 @@
+package gonfic
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"sort"
+	"strings"
+)
+
+// Validate checks the config, as an hierarchical JSON document, against
+// the JSON Schema schema, reporting every violation (a missing required key,
+// a value of the wrong type, a number out of range, ...) with the location
+// of the offending value, like /server/port.
+func (c *Config) Validate(schema []byte) error {
+	compiler := jsonschema.NewCompiler()
+	if err := compiler.AddResource("schema.json", bytes.NewReader(schema)); err != nil {
+		return fmt.Errorf("cannot read schema: %w", err)
+	}
+	s, err := compiler.Compile("schema.json")
+	if err != nil {
+		return fmt.Errorf("cannot compile schema: %w", err)
+	}
+	buf, err := json.Marshal(c.ToHierarchicalMap())
+	if err != nil {
+		return fmt.Errorf("cannot validate: %w", err)
+	}
+	// the schema expects the values as decoded from JSON, not as loaded
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return fmt.Errorf("cannot validate: %w", err)
+	}
+	err = s.Validate(doc)
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return err
+	}
+	var violations []string
+	collectViolations(ve, &violations)
+	sort.Strings(violations)
+	return fmt.Errorf("invalid config: %s", strings.Join(violations, "; "))
+}
+
+// collectViolations appends the leaf errors of ve, which are the actual violations.
+func collectViolations(ve *jsonschema.ValidationError, violations *[]string) {
+	if len(ve.Causes) == 0 {
+		location := ve.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		*violations = append(*violations, location+": "+ve.Message)
+		return
+	}
+	for _, cause := range ve.Causes {
+		collectViolations(cause, violations)
+	}
+}
@@ -0,0 +1,164 @@
+// Package vipercompat exposes a gonfic config through a subset of the API
+// of spf13/viper, so code migrating from viper mostly compiles unchanged.
+//
+// Supported: Get, GetString, GetInt, GetInt64, GetFloat64, GetBool,
+// GetDuration, GetStringSlice, GetStringMap, GetStringMapString, IsSet,
+// AllKeys, AllSettings, Set, SetDefault, Sub, Unmarshal and UnmarshalKey.
+// Keys are case insensitive and dotted, as in viper.
+//
+// Not supported: finding and reading config files (SetConfigName,
+// AddConfigPath, ReadInConfig; add gonfic sources to the Config instead),
+// WatchConfig, remote providers, AutomaticEnv and BindEnv (use gonfic's
+// env source), BindPFlag, aliases, custom key delimiters, and writing
+// config files.
+package vipercompat
+
+import (
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/pierredavidbelanger/gonfic"
+)
+
+// Viper is a viper like view of a gonfic config.
+type Viper struct {
+	c *gonfic.Config
+}
+
+// New returns a Viper backed by a new empty config.
+func New() *Viper {
+	return NewWithConfig(gonfic.NewConfig())
+}
+
+// NewWithConfig returns a Viper backed by c.
+func NewWithConfig(c *gonfic.Config) *Viper {
+	return &Viper{c: c}
+}
+
+// Config returns the config backing v.
+func (v *Viper) Config() *gonfic.Config {
+	return v.c
+}
+
+// Get returns the value of key, the map of the keys under key
+// if key is not set itself, or nil.
+func (v *Viper) Get(key string) interface{} {
+	key = strings.ToLower(key)
+	if value, ok := v.c.Get(key); ok {
+		return value
+	}
+	if m := v.c.GetStringMap(key); len(m) > 0 {
+		return m
+	}
+	return nil
+}
+
+// IsSet returns whether key, or any key under it, is set.
+func (v *Viper) IsSet(key string) bool {
+	return v.Get(key) != nil
+}
+
+func (v *Viper) GetString(key string) string {
+	var s string
+	v.decode(key, &s)
+	return s
+}
+
+func (v *Viper) GetInt(key string) int {
+	var i int
+	v.decode(key, &i)
+	return i
+}
+
+func (v *Viper) GetInt64(key string) int64 {
+	var i int64
+	v.decode(key, &i)
+	return i
+}
+
+func (v *Viper) GetFloat64(key string) float64 {
+	var f float64
+	v.decode(key, &f)
+	return f
+}
+
+func (v *Viper) GetBool(key string) bool {
+	var b bool
+	v.decode(key, &b)
+	return b
+}
+
+// GetDuration returns the value of key as a duration, from a string
+// like "1m30s" or from a number of nanoseconds.
+func (v *Viper) GetDuration(key string) time.Duration {
+	d, _ := v.c.GetDuration(strings.ToLower(key))
+	return d
+}
+
+func (v *Viper) GetStringSlice(key string) []string {
+	var a []string
+	v.decode(key, &a)
+	return a
+}
+
+func (v *Viper) GetStringMap(key string) map[string]interface{} {
+	return v.c.GetStringMap(strings.ToLower(key))
+}
+
+func (v *Viper) GetStringMapString(key string) map[string]string {
+	m := make(map[string]string)
+	v.decode(key, &m)
+	return m
+}
+
+// decode weakly decodes the value of key unto out, leaving it untouched on failure.
+func (v *Viper) decode(key string, out interface{}) {
+	if value := v.Get(key); value != nil {
+		mapstructure.WeakDecode(value, out)
+	}
+}
+
+// AllKeys returns every key, in sorted order.
+func (v *Viper) AllKeys() []string {
+	return v.c.Keys()
+}
+
+// AllSettings returns every key and value as an hierarchical map.
+func (v *Viper) AllSettings() map[string]interface{} {
+	return v.c.AllSettings()
+}
+
+// Set overrides the value of key, above every source.
+// A map value sets the keys under key.
+func (v *Viper) Set(key string, value interface{}) {
+	v.c.Set(key, value)
+}
+
+// SetDefault sets the value of key used when no source sets it.
+func (v *Viper) SetDefault(key string, value interface{}) {
+	v.c.SetDefault(key, value)
+}
+
+// Sub returns a Viper of the keys under key, or nil if there is none.
+func (v *Viper) Sub(key string) *Viper {
+	sub := v.c.Sub(key)
+	if sub.IsEmpty() {
+		return nil
+	}
+	return NewWithConfig(sub)
+}
+
+// Unmarshal decodes every key unto rawVal, usually a pointer to a struct.
+func (v *Viper) Unmarshal(rawVal interface{}) error {
+	return v.c.Unmarshal("", rawVal)
+}
+
+// UnmarshalKey decodes the value of key, or the keys under it, unto rawVal.
+func (v *Viper) UnmarshalKey(key string, rawVal interface{}) error {
+	key = strings.ToLower(key)
+	if value, ok := v.c.Get(key); ok {
+		return mapstructure.WeakDecode(value, rawVal)
+	}
+	return v.c.Unmarshal(key, rawVal)
+}
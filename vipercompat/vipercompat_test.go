@@ -0,0 +1,46 @@
+package vipercompat
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pierredavidbelanger/gonfic"
+)
+
+func TestViper(t *testing.T) {
+	c := gonfic.NewConfig()
+	c.AddSource(gonfic.NewBufSource([]byte(`{"server": {"port": "8080", "debug": "true", "timeout": "2s", "hosts": ["a", "b"]}}`), "json"))
+	v := NewWithConfig(c)
+	v.SetDefault("server.name", "app")
+	if v.GetInt("Server.Port") != 8080 || !v.GetBool("server.debug") || v.GetString("server.name") != "app" {
+		t.Errorf("unexpected values: %v", v.AllSettings())
+	}
+	if v.GetDuration("server.timeout") != 2*time.Second || fmt.Sprint(v.GetStringSlice("server.hosts")) != "[a b]" {
+		t.Errorf("unexpected values: %v", v.AllSettings())
+	}
+	if !v.IsSet("server") || v.IsSet("missing") || v.GetString("missing") != "" {
+		t.Errorf("unexpected IsSet")
+	}
+	v.Set("server", map[string]interface{}{"port": 9090})
+	sub := v.Sub("server")
+	if sub == nil || sub.GetInt("port") != 9090 || sub.GetString("name") != "app" {
+		t.Errorf("unexpected sub: %v", sub)
+	}
+	var s struct {
+		Server struct {
+			Port  int
+			Hosts []string
+		}
+	}
+	if err := v.Unmarshal(&s); err != nil || s.Server.Port != 9090 {
+		t.Errorf("unexpected unmarshal: %+v (%v)", s, err)
+	}
+	var port int
+	if err := v.UnmarshalKey("server.port", &port); err != nil || port != 9090 {
+		t.Errorf("unexpected unmarshal key: %d (%v)", port, err)
+	}
+	if fmt.Sprint(v.AllKeys()) != "[server.debug server.hosts server.name server.port server.timeout]" {
+		t.Errorf("unexpected keys: %v", v.AllKeys())
+	}
+}
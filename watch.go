@@ -0,0 +1,184 @@
+package gonfic
+
+import (
+	"fmt"
+	"github.com/fsnotify/fsnotify"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultDebounce is how long a watcher waits after a file changed before
+// reloading the config, unless changed with WithDebounce.
+const DefaultDebounce = 100 * time.Millisecond
+
+// Watcher reloads a config when its files change, see Config.Watch.
+type Watcher struct {
+	c        *Config
+	watcher  *fsnotify.Watcher
+	paths    map[string]bool
+	onChange func(*Config, error) error
+	debounce time.Duration
+	done     chan struct{}
+	once     sync.Once
+	stopErr  error
+	err      error
+	// mu guards inCallback and stopped
+	mu         sync.Mutex
+	inCallback bool
+	stopped    bool
+}
+
+// WatchOption alters the way a watcher reloads the config.
+type WatchOption func(*Watcher)
+
+// WithDebounce sets how long the watcher waits after a file changed before
+// reloading the config, any change meanwhile restarting the wait, so that
+// an editor writing a file twice triggers a single reload (defaults to DefaultDebounce).
+func WithDebounce(d time.Duration) WatchOption {
+	return func(w *Watcher) {
+		w.debounce = d
+	}
+}
+
+// Watch watches the files of the file sources added so far and, when any
+// of them changes, reloads the config by applying again every source,
+// in order, on an empty flat map, then calls onChange with the config
+// and a nil error. A reload is atomic: if any source fails, like a file
+// that does not parse, the config is left untouched and onChange is called
+// with the config and the error (onChange also gets the errors of the watch itself).
+// The directories of the files are watched, rather than the files, so a file
+// replaced by a rename, as editors do, or created after the call, is still seen.
+// Call Stop on the returned watcher to stop watching. If onChange returns
+// an error, the watch stops too, and Stop returns that error.
+func (c *Config) Watch(onChange func(*Config, error) error, opts ...WatchOption) (*Watcher, error) {
+	w := &Watcher{c: c, paths: make(map[string]bool), onChange: onChange, debounce: DefaultDebounce, done: make(chan struct{})}
+	for _, opt := range opts {
+		opt(w)
+	}
+	c.mu.RLock()
+	for _, e := range c.sources {
+		if s, ok := e.source.(*fileSource); ok {
+			w.paths[filepath.Clean(s.path)] = true
+		}
+	}
+	c.mu.RUnlock()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("cannot watch: %w", err)
+	}
+	w.watcher = watcher
+	dirs := make(map[string]bool)
+	for path := range w.paths {
+		dir := filepath.Dir(path)
+		if dirs[dir] {
+			continue
+		}
+		dirs[dir] = true
+		if err := watcher.Add(dir); err != nil {
+			watcher.Close()
+			return nil, fmt.Errorf("cannot watch %s: %w", dir, err)
+		}
+	}
+	go w.run()
+	return w, nil
+}
+
+// Stop stops watching, waiting for a reload in progress to end.
+// onChange is not called anymore once it returns. It returns the error
+// that onChange returned to stop the watch, if it did.
+// While onChange runs, Stop does not wait for it to return, so that onChange
+// can call Stop; onChange is not called again either way.
+func (w *Watcher) Stop() error {
+	w.once.Do(func() {
+		w.mu.Lock()
+		w.stopped = true
+		inCallback := w.inCallback
+		w.mu.Unlock()
+		w.err = w.watcher.Close()
+		if inCallback {
+			return
+		}
+		<-w.done
+		if w.stopErr != nil {
+			w.err = w.stopErr
+		}
+	})
+	return w.err
+}
+
+func (w *Watcher) run() {
+	defer close(w.done)
+	var timer *time.Timer
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if !w.paths[filepath.Clean(event.Name)] || event.Op == fsnotify.Chmod {
+				continue
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(w.debounce)
+			reload = timer.C
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			if !w.notify(fmt.Errorf("cannot watch: %w", err)) {
+				return
+			}
+		case <-reload:
+			reload = nil
+			err := w.c.reload()
+			if err != nil {
+				err = fmt.Errorf("cannot reload: %w", err)
+			}
+			if !w.notify(err) {
+				return
+			}
+		}
+	}
+}
+
+// notify calls onChange with err, and returns whether to keep watching.
+func (w *Watcher) notify(err error) bool {
+	w.mu.Lock()
+	if w.stopped {
+		w.mu.Unlock()
+		return false
+	}
+	w.inCallback = true
+	w.mu.Unlock()
+	err = w.onChange(w.c, err)
+	w.mu.Lock()
+	w.inCallback = false
+	stopped := w.stopped
+	w.mu.Unlock()
+	if err != nil {
+		w.stopErr = err
+		w.watcher.Close()
+		return false
+	}
+	return !stopped
+}
+
+// reload applies again every source of the config, in order, on an empty flat map.
+func (c *Config) reload() error {
+	return c.measure(c.replaySources())
+}
+
+func (c *Config) replaySources() error {
+	c.lock()
+	defer c.unlock()
+	entries, err := c.replay(make(map[string]interface{}), c.sources)
+	if err != nil {
+		return err
+	}
+	c.commit(entries)
+	return nil
+}
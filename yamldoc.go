@@ -0,0 +1,116 @@
+package gonfic
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// YAMLDocument is a YAML document that can be edited with Set and written back
+// with ToYAML while keeping its comments and the order of its keys,
+// for tools that edit config files on behalf of their users.
+// It is also a source that loads the keys and values of the document.
+type YAMLDocument struct {
+	root yaml.Node
+}
+
+// NewYAMLDocument parses buf into a YAMLDocument. An empty buf gives an empty document.
+func NewYAMLDocument(buf []byte) (*YAMLDocument, error) {
+	d := &YAMLDocument{}
+	if err := yaml.Unmarshal(buf, &d.root); err != nil {
+		return nil, &Error{Kind: ErrParse, Err: fmt.Errorf("cannot parse yaml document: %w", err)}
+	}
+	if d.root.Kind == 0 {
+		d.root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if d.root.Content[0].Kind != yaml.MappingNode {
+		return nil, &Error{Kind: ErrParse, Err: fmt.Errorf("cannot parse yaml document: not a map")}
+	}
+	return d, nil
+}
+
+func (d *YAMLDocument) String() string {
+	return "yaml document"
+}
+
+// Set sets the value of the dotted key, creating the maps along its path as needed.
+// Keys are matched case insensitively, as sources lowercase them.
+// When key already exists, its comments are kept.
+func (d *YAMLDocument) Set(key string, value interface{}) error {
+	var node yaml.Node
+	if err := node.Encode(value); err != nil {
+		return fmt.Errorf("cannot set %s: %w", key, err)
+	}
+	m := d.root.Content[0]
+	keys := dotSlicer(key)
+	for i, k := range keys {
+		index := mappingIndex(m, k)
+		if i == len(keys)-1 {
+			if index < 0 {
+				m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k}, &node)
+				return nil
+			}
+			old := m.Content[index+1]
+			node.HeadComment, node.LineComment, node.FootComment = old.HeadComment, old.LineComment, old.FootComment
+			*old = node
+			return nil
+		}
+		if index < 0 {
+			m.Content = append(m.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: k}, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+			index = len(m.Content) - 2
+		}
+		m = m.Content[index+1]
+		if m.Kind != yaml.MappingNode {
+			return fmt.Errorf("cannot set %s: %s is not a map", key, strings.Join(keys[:i+1], "."))
+		}
+	}
+	return nil
+}
+
+// mappingIndex returns the index of the node of key k in the mapping node m, or -1.
+func mappingIndex(m *yaml.Node, k string) int {
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if m.Content[i].Value == k {
+			return i
+		}
+	}
+	for i := 0; i+1 < len(m.Content); i += 2 {
+		if strings.EqualFold(m.Content[i].Value, k) {
+			return i
+		}
+	}
+	return -1
+}
+
+// ToYAML returns the document as YAML, with its comments.
+func (d *YAMLDocument) ToYAML() ([]byte, error) {
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(&d.root); err != nil {
+		return nil, fmt.Errorf("cannot write yaml document: %w", err)
+	}
+	if err := enc.Close(); err != nil {
+		return nil, fmt.Errorf("cannot write yaml document: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+func (d *YAMLDocument) Override(config map[string]interface{}) (map[string]interface{}, error) {
+	return d.OverrideContext(context.Background(), config)
+}
+
+// OverrideContext is like Override, with the key separator of ctx.
+func (d *YAMLDocument) OverrideContext(ctx context.Context, config map[string]interface{}) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	if err := d.root.Decode(&m); err != nil {
+		return nil, &Error{Kind: ErrParse, Err: fmt.Errorf("cannot decode yaml document: %w", err)}
+	}
+	for key, value := range flatten(normalizeMap(m), joiner(SeparatorFromContext(ctx))) {
+		config[strings.ToLower(key)] = value
+	}
+	return config, nil
+}